@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/* definitions */
+
+/* A parsed aggregate_expression.  A leaf names a rule, which is true while
+ * it's successful, otherwise op is one of '!', '&', or '|', over args.
+ */
+type aggregateExpr struct {
+	op   byte
+	name string
+	args []*aggregateExpr
+}
+
+/* what an aggregate_expression is made of */
+type aggregateParser struct {
+	tokens []string
+	pos    int
+}
+
+/* meat */
+
+/* split s into names, parentheses, and operators */
+func tokenizeAggregate(s string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(', c == ')', c == '!':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '&', c == '|':
+			if i+1 >= len(s) || s[i+1] != c {
+				return nil, fmt.Errorf("expected '%c%c' at offset %d", c, c, i)
+			}
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune("()!&| \t\r\n", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+/* Parse a boolean expression over rule names, with !, &&, ||, and
+ * parentheses, binding in that order.
+ */
+func parseAggregateExpression(s string) (*aggregateExpr, error) {
+	tokens, err := tokenizeAggregate(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := aggregateParser{tokens: tokens}
+
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+
+	return expr, nil
+}
+
+func (p *aggregateParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *aggregateParser) or() (*aggregateExpr, error) {
+	return p.binary('|', "||", p.and)
+}
+
+func (p *aggregateParser) and() (*aggregateExpr, error) {
+	return p.binary('&', "&&", p.unary)
+}
+
+/* one or more operands, separated by token */
+func (p *aggregateParser) binary(op byte, token string, operand func() (*aggregateExpr, error)) (*aggregateExpr, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	expr := &aggregateExpr{op: op, args: []*aggregateExpr{first}}
+	for p.peek() == token {
+		p.pos++
+
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+
+		expr.args = append(expr.args, next)
+	}
+
+	if len(expr.args) == 1 {
+		return first, nil
+	}
+
+	return expr, nil
+}
+
+func (p *aggregateParser) unary() (*aggregateExpr, error) {
+	token := p.peek()
+	p.pos++
+
+	switch token {
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	case "!":
+		arg, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &aggregateExpr{op: '!', args: []*aggregateExpr{arg}}, nil
+	case "(":
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ")" {
+			return nil, errors.New("expected ')'")
+		}
+		p.pos++
+
+		return expr, nil
+	case ")", "&&", "||":
+		return nil, fmt.Errorf("unexpected '%s'", token)
+	}
+
+	return &aggregateExpr{name: token}, nil
+}
+
+/* the rule names the expression refers to, in order of appearance */
+func (e *aggregateExpr) names() []string {
+	if e.op == 0 {
+		return []string{e.name}
+	}
+
+	var names []string
+	for _, arg := range e.args {
+		names = append(names, arg.names()...)
+	}
+
+	return names
+}
+
+/* Evaluate the expression, with success as true, and fail as false.  Unknown
+ * is neither, and only decides the result when the known values don't.
+ */
+func (e *aggregateExpr) eval(state func(name string) RuleStateType) RuleStateType {
+	switch e.op {
+	case 0:
+		return state(e.name)
+	case '!':
+		switch e.args[0].eval(state) {
+		case RuleStateSuccess:
+			return RuleStateFail
+		case RuleStateFail:
+			return RuleStateSuccess
+		}
+
+		return RuleStateUnknown
+	}
+
+	/* the value that decides && is false, and || is true */
+	decides, otherwise := RuleStateFail, RuleStateSuccess
+	if e.op == '|' {
+		decides, otherwise = RuleStateSuccess, RuleStateFail
+	}
+
+	result := otherwise
+	for _, arg := range e.args {
+		switch arg.eval(state) {
+		case decides:
+			return decides
+		case RuleStateUnknown:
+			result = RuleStateUnknown
+		}
+	}
+
+	return result
+}
+
+/* every rule this one refers to: those it depends on, and aggregates */
+func (rule *Rule) references() []string {
+	names := append([]string(nil), rule.DependsOn...)
+	names = append(names, rule.AggregateRules...)
+
+	if rule.AggregateExpression != "" {
+		/* already validated when parsed */
+		if expr, err := parseAggregateExpression(rule.AggregateExpression); err == nil {
+			names = append(names, expr.names()...)
+		}
+	}
+
+	return names
+}
+
+/* the state of a rule as aggregates see it, a warning is still up */
+func (rd *RuleDriver) aggregateState(name string) RuleStateType {
+	if state := rd.deps.state(name); state != RuleStateWarning {
+		return state
+	}
+
+	return RuleStateSuccess
+}
+
+/* derive the rule's state from the states of other rules */
+func runAggregateTest(ctx context.Context, rd *RuleDriver, deadline time.Time) error {
+	var state RuleStateType
+
+	switch rd.Rule.Aggregate {
+	case RuleAggregateKOfN, RuleAggregateAnySuccess:
+		var counts [3]int
+		for _, name := range rd.Rule.AggregateRules {
+			counts[rd.aggregateState(name)]++
+		}
+
+		n := len(rd.Rule.AggregateRules)
+		if rd.Rule.Aggregate == RuleAggregateKOfN {
+			k := int(rd.Rule.AggregateFailCount)
+			if k == 0 {
+				k = 1
+			}
+
+			rd.Last.Message = fmt.Sprintf("%d of %d rules failed, failing at %d", counts[RuleStateFail], n, k)
+			switch {
+			case counts[RuleStateFail] >= k:
+				state = RuleStateFail
+			case counts[RuleStateFail]+counts[RuleStateUnknown] >= k:
+				state = RuleStateUnknown
+			default:
+				state = RuleStateSuccess
+			}
+		} else {
+			rd.Last.Message = fmt.Sprintf("%d of %d rules successful", counts[RuleStateSuccess], n)
+			switch {
+			case counts[RuleStateSuccess] > 0:
+				state = RuleStateSuccess
+			case counts[RuleStateUnknown] > 0:
+				state = RuleStateUnknown
+			default:
+				state = RuleStateFail
+			}
+		}
+	case RuleAggregateExpression:
+		expr, err := parseAggregateExpression(rd.Rule.AggregateExpression)
+		if err != nil {
+			return err
+		}
+
+		state = expr.eval(rd.aggregateState)
+		rd.Last.Message = fmt.Sprintf("'%s' is %v", rd.Rule.AggregateExpression, state == RuleStateSuccess)
+	}
+
+	switch state {
+	case RuleStateUnknown:
+		return errUndetermined
+	case RuleStateFail:
+		return errors.New(rd.Last.Message)
+	}
+
+	return nil
+}
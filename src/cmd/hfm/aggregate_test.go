@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "reflect"
+import "testing"
+
+func TestAggregateExpression(t *testing.T) {
+	states := map[string]RuleStateType{
+		"up":      RuleStateSuccess,
+		"g1/up":   RuleStateSuccess,
+		"down":    RuleStateFail,
+		"pending": RuleStateUnknown,
+	}
+	state := func(name string) RuleStateType { return states[name] }
+
+	tests := []struct {
+		expr     string
+		expected RuleStateType
+	}{
+		{"up", RuleStateSuccess},
+		{"!up", RuleStateFail},
+		{"up && g1/up", RuleStateSuccess},
+		{"up && down", RuleStateFail},
+		{"up || down", RuleStateSuccess},
+		{"!(up && down)", RuleStateSuccess},
+		{"down || up && down", RuleStateFail},
+		{"(down || up) && up", RuleStateSuccess},
+		{"pending && down", RuleStateFail},
+		{"pending && up", RuleStateUnknown},
+		{"pending || up", RuleStateSuccess},
+		{"!pending", RuleStateUnknown},
+		{"missing", RuleStateUnknown},
+	}
+
+	for _, test := range tests {
+		expr, err := parseAggregateExpression(test.expr)
+		if err != nil {
+			t.Errorf("Received error for '%s': %v", test.expr, err)
+			continue
+		}
+
+		if got := expr.eval(state); got != test.expected {
+			t.Errorf("Expected '%s' to be %v, got: %v", test.expr, test.expected, got)
+		}
+	}
+
+	expr, _ := parseAggregateExpression("a && (b || !c) || a")
+	if names := expr.names(); !reflect.DeepEqual(names, []string{"a", "b", "c", "a"}) {
+		t.Errorf("Received unexpected names: %v", names)
+	}
+
+	for _, bad := range []string{"", "a &&", "a & b", "(a || b", "a b", "a || )", "!"} {
+		if _, err := parseAggregateExpression(bad); err == nil {
+			t.Errorf("Expected error for '%s'", bad)
+		}
+	}
+}
+
+/* the result of one run of the aggregate rule r, among rules with states */
+func runAggregateRule(t *testing.T, cfg string, states map[string]RuleStateType) *RuleDriver {
+	var c Configuration
+
+	cfg = `a { test="true" } b { test="true" } c { test="true" } r { test_type="aggregate"; runs=1; ` + cfg + ` }`
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	deps := NewDependencies()
+	for name, state := range states {
+		deps.set(name, dependencyState{State: state})
+	}
+
+	ruleDone := make(chan *RuleDriver)
+
+	driver := NewRuleDriver(*c.Rules["r"], ruleDone, 0)
+	driver.deps = deps
+	go driver.Run()
+	<-ruleDone
+
+	return driver
+}
+
+func TestDriverAggregate(t *testing.T) {
+	success, fail := RuleStateSuccess, RuleStateFail
+
+	tests := []struct {
+		cfg      string
+		states   map[string]RuleStateType
+		expected RuleStateType
+	}{
+		{`aggregate_rules=["a", "b", "c"]`, map[string]RuleStateType{"a": success, "b": success, "c": success}, success},
+		{`aggregate_rules=["a", "b", "c"]`, map[string]RuleStateType{"a": success, "b": fail, "c": success}, fail},
+		{`aggregate_rules=["a", "b", "c"]; aggregate_fail_count=2`, map[string]RuleStateType{"a": success, "b": fail, "c": success}, success},
+		{`aggregate_rules=["a", "b", "c"]; aggregate_fail_count=2`, map[string]RuleStateType{"a": fail, "b": fail, "c": success}, fail},
+		{`aggregate_rules=["a", "b", "c"]; aggregate_fail_count=2`, map[string]RuleStateType{"a": fail, "c": success}, RuleStateUnknown},
+		{`aggregate="any-success"; aggregate_rules=["a", "b", "c"]`, map[string]RuleStateType{"a": fail, "b": fail, "c": success}, success},
+		{`aggregate="any-success"; aggregate_rules=["a", "b", "c"]`, map[string]RuleStateType{"a": fail, "b": fail, "c": fail}, fail},
+		{`aggregate="any-success"; aggregate_rules=["a", "b", "c"]`, map[string]RuleStateType{"a": fail, "b": fail}, RuleStateUnknown},
+		{`aggregate="expression"; aggregate_expression="a && (b || c)"`, map[string]RuleStateType{"a": success, "b": fail, "c": success}, success},
+		{`aggregate="expression"; aggregate_expression="a && (b || c)"`, map[string]RuleStateType{"a": success, "b": fail, "c": fail}, fail},
+	}
+
+	for _, test := range tests {
+		driver := runAggregateRule(t, test.cfg, test.states)
+		if got := driver.Snapshot().Rule.LastState; got != test.expected {
+			t.Errorf("Expected %v for %s, with %v, got: %v", test.expected, test.cfg, test.states, got)
+		}
+	}
+}
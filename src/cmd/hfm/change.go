@@ -0,0 +1,463 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"bytes"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* definitions */
+
+/* how long a change command may run by default, so a hung one doesn't hold
+ * its process, and the rule's change lock forever
+ */
+const defaultChangeTimeoutKill = 5 * time.Minute
+
+/* a change command to run, captured from the driver as of the state change */
+type changeRequest struct {
+	State   RuleStateType
+	Command string
+	Args    []string
+	Env     []string
+
+	/* the run that changed the state */
+	RunUid string
+
+	TimeoutInt  time.Duration
+	TimeoutKill time.Duration
+
+	/* how many times to retry on failure, and how long to wait in between,
+	 * doubling the wait each time if RetryBackoff
+	 */
+	Retries       uint16
+	RetryInterval time.Duration
+	RetryBackoff  bool
+}
+
+/* the result of running a change command */
+type ChangeRecord struct {
+	/* the state the command was run for */
+	State   RuleStateType
+	Command string
+	RunUid  string
+
+	Start    time.Time
+	Duration time.Duration
+
+	/* -1 if the command couldn't be started, or was killed by a signal */
+	ExitStatus int
+	Error      string
+
+	/* whether the change_timeout_int or change_timeout_kill signals were
+	 * sent
+	 */
+	Interrupted bool
+	Killed      bool
+
+	/* 1 for the first try, more for retries */
+	Attempt int
+}
+
+/* the progress of a rule's change commands, shared by the driver and the
+ * change commands it has started
+ */
+type changeState struct {
+	sync.Mutex
+
+	/* the state last changed to, and closed, and replaced when it
+	 * changes
+	 */
+	target  RuleStateType
+	changed chan struct{}
+
+	/* the change command to target hasn't completed successfully yet, or
+	 * it has given up trying
+	 */
+	pending bool
+	failed  bool
+
+	/* when serialized, whether a change command is running, or waiting for
+	 * its lock, and the latest change to make once it completes, earlier
+	 * ones are replaced
+	 */
+	running bool
+	queued  *changeRequest
+}
+
+/* named locks, shared by the rules' change commands that use them */
+type changeLockSet struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+var changeLocks = changeLockSet{locks: make(map[string]*sync.Mutex)}
+
+/* meat */
+
+func newChangeState() *changeState {
+	return &changeState{changed: make(chan struct{})}
+}
+
+/* the lock by name, created if it doesn't exist */
+func (s *changeLockSet) get(name string) *sync.Mutex {
+	s.Lock()
+	defer s.Unlock()
+
+	l, ok := s.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[name] = l
+	}
+
+	return l
+}
+
+/* The rule has changed state, with a change command to run or not.  An
+ * always-success, or always-fail status repeats the same state, which leaves
+ * change commands already running for it alone.
+ */
+func (cs *changeState) transition(state RuleStateType, command bool) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if state == cs.target {
+		cs.pending = cs.pending || command
+		return
+	}
+
+	cs.target = state
+	cs.pending = command
+	cs.failed = false
+
+	close(cs.changed)
+	cs.changed = make(chan struct{})
+}
+
+/* whether the rule has changed state since the request, and a channel closed
+ * if it does
+ */
+func (cs *changeState) superseded(req changeRequest) (bool, <-chan struct{}) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	return cs.target != req.State, cs.changed
+}
+
+/* a change command for state is done trying, successfully or not */
+func (cs *changeState) complete(state RuleStateType, ok bool) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.target == state {
+		cs.pending = false
+		cs.failed = !ok
+	}
+}
+
+/* the state last changed to */
+func (cs *changeState) state() RuleStateType {
+	cs.Lock()
+	defer cs.Unlock()
+
+	return cs.target
+}
+
+func (cs *changeState) flags() (pending bool, failed bool) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	return cs.pending, cs.failed
+}
+
+/* start the change command, or queue it behind the one running */
+func (rd *RuleDriver) startChange(req changeRequest) {
+	if !rd.Rule.ChangeSerialize && rd.Rule.ChangeLock == "" {
+		rd.children.changes.Add(1)
+		go func() {
+			defer rd.children.changes.Done()
+
+			rd.applyChange(req, nil)
+		}()
+
+		return
+	}
+
+	cs := rd.changeState
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.running {
+		if cs.queued != nil {
+			log.Info("'%s' run %s change command to %v replaces the one queued to %v", rd.Rule.Name, req.RunUid, req.State, cs.queued.State)
+		} else {
+			log.Info("'%s' run %s change command to %v queued", rd.Rule.Name, req.RunUid, req.State)
+		}
+
+		cs.queued = &req
+		return
+	}
+
+	cs.running = true
+
+	var lock *sync.Mutex
+	if rd.Rule.ChangeLock != "" {
+		lock = changeLocks.get(rd.Rule.ChangeLock)
+	}
+
+	rd.children.changes.Add(1)
+	go rd.serveChanges(req, lock)
+}
+
+/* run change commands one at a time, until there are none queued */
+func (rd *RuleDriver) serveChanges(req changeRequest, lock *sync.Mutex) {
+	defer rd.children.changes.Done()
+
+	cs := rd.changeState
+
+	for {
+		ok := rd.applyChange(req, lock)
+
+		cs.Lock()
+		next := cs.queued
+		cs.queued = nil
+
+		switch {
+		case next == nil:
+		case rd.children.isAborted():
+			log.Info("'%s' run %s change command to %v dropped by shutdown", rd.Rule.Name, next.RunUid, next.State)
+			next = nil
+		case next.State == req.State && ok:
+			/* the rule went the other way, and back */
+			log.Info("'%s' run %s change command to %v skipped, it was just made", rd.Rule.Name, next.RunUid, next.State)
+			cs.pending = false
+			next = nil
+		}
+
+		if next == nil {
+			cs.running = false
+			cs.Unlock()
+			return
+		}
+		cs.Unlock()
+
+		req = *next
+	}
+}
+
+/* Run the change command, and retry it as configured until it succeeds.
+ * Retries are abandoned once the rule changes state again, or the driver is
+ * stopped.  True if it succeeded.
+ */
+func (rd *RuleDriver) applyChange(req changeRequest, lock *sync.Mutex) bool {
+	interval := req.RetryInterval
+
+	for attempt := 1; ; attempt++ {
+		if lock != nil {
+			lock.Lock()
+		}
+		rec := rd.runChange(req)
+		if lock != nil {
+			lock.Unlock()
+		}
+
+		rec.Attempt = attempt
+		rd.recordChange(rec)
+
+		if rec.ExitStatus == 0 && rec.Error == "" {
+			rd.changeState.complete(req.State, true)
+			return true
+		}
+
+		if attempt > int(req.Retries) {
+			if req.Retries > 0 {
+				log.Error("'%s' run %s change command to %v failed, giving up after %d attempts", rd.Rule.Name, req.RunUid, req.State, attempt)
+			}
+			rd.changeState.complete(req.State, false)
+			return false
+		}
+
+		superseded, changed := rd.changeState.superseded(req)
+		if superseded {
+			log.Info("'%s' run %s change command to %v not retried, the rule has changed state since", rd.Rule.Name, req.RunUid, req.State)
+			return false
+		}
+
+		log.Warning("'%s' run %s change command to %v retrying in %v", rd.Rule.Name, req.RunUid, req.State, interval)
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+			log.Info("'%s' run %s change command to %v not retried, the rule has changed state since", rd.Rule.Name, req.RunUid, req.State)
+			return false
+		case <-rd.quit:
+			timer.Stop()
+			log.Info("'%s' run %s change command to %v not retried, the rule is stopping", rd.Rule.Name, req.RunUid, req.State)
+			rd.changeState.complete(req.State, false)
+			return false
+		}
+
+		if req.RetryBackoff {
+			interval *= 2
+		}
+	}
+}
+
+func (rd *RuleDriver) newChangeRequest(newState RuleStateType, env []string) changeRequest {
+	req := changeRequest{
+		State:       newState,
+		Env:         env,
+		RunUid:      rd.GetRunUid(),
+		TimeoutInt:  rd.Rule.ChangeTimeoutInt,
+		TimeoutKill: rd.Rule.ChangeTimeoutKill,
+
+		Retries:       rd.Rule.ChangeRetries,
+		RetryInterval: rd.Rule.ChangeRetryInterval,
+		RetryBackoff:  rd.Rule.ChangeRetryBackoff,
+	}
+
+	switch newState {
+	case RuleStateSuccess:
+		req.Command = rd.Rule.ChangeSuccess
+		req.Args = rd.Rule.ChangeSuccessArguments
+	case RuleStateWarning:
+		req.Command = rd.Rule.ChangeWarning
+		req.Args = rd.Rule.ChangeWarningArguments
+	default:
+		req.Command = rd.Rule.ChangeFail
+		req.Args = rd.Rule.ChangeFailArguments
+	}
+
+	return req
+}
+
+/* Run a change command to completion, or until it's killed.  Runs outside of
+ * the driver's goroutine, so only uses what's safe to share.
+ */
+func (rd *RuleDriver) runChange(req changeRequest) ChangeRecord {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	rec := ChangeRecord{State: req.State, Command: req.Command, RunUid: req.RunUid, Start: time.Now()}
+
+	cmd := exec.Command(req.Command, req.Args...)
+	cmd.Env = req.Env
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		rec.ExitStatus = -1
+		rec.Error = err.Error()
+		log.Error("'%s' run %s change command failed to start: %v", rd.Rule.Name, req.RunUid, err)
+
+		return rec
+	}
+
+	rd.children.add(cmd.Process)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeoutInt, timeoutKill <-chan time.Time
+	if req.TimeoutInt > 0 {
+		t := time.NewTimer(req.TimeoutInt)
+		defer t.Stop()
+		timeoutInt = t.C
+	}
+	if req.TimeoutKill > 0 {
+		t := time.NewTimer(req.TimeoutKill)
+		defer t.Stop()
+		timeoutKill = t.C
+	}
+
+	var err error
+
+wait:
+	for {
+		select {
+		case err = <-done:
+			break wait
+		case <-timeoutInt:
+			timeoutInt = nil
+			log.Info("'%s' run %s change command interrupt timeout exceeded, issuing interrupt.", rd.Rule.Name, req.RunUid)
+			rec.Interrupted = true
+			cmd.Process.Signal(syscall.SIGINT)
+		case <-timeoutKill:
+			timeoutKill = nil
+			log.Warning("'%s' run %s change command kill timeout exceeded, issuing kill.", rd.Rule.Name, req.RunUid)
+			rec.Killed = true
+			cmd.Process.Kill()
+		}
+	}
+
+	rd.children.remove(cmd.Process)
+	rec.Duration = time.Since(rec.Start)
+
+	if stdout.Len() > 0 {
+		log.Info("'%s' run %s change command produced output: %v", rd.Rule.Name, req.RunUid, stdout.String())
+	}
+	if stderr.Len() > 0 {
+		log.Error("'%s' run %s change command produced error output: %v", rd.Rule.Name, req.RunUid, stderr.String())
+	}
+
+	if err != nil {
+		rec.Error = err.Error()
+		rec.ExitStatus = -1
+		if ee, ok := err.(*exec.ExitError); ok {
+			if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+				rec.ExitStatus = ws.ExitStatus()
+			}
+		}
+
+		log.Error("'%s' run %s change command to %v failed after %v: %v", rd.Rule.Name, req.RunUid, req.State, rec.Duration, err)
+	} else {
+		log.Info("'%s' run %s change command to %v completed in %v", rd.Rule.Name, req.RunUid, req.State, rec.Duration)
+	}
+
+	return rec
+}
+
+/* make the result of a change command available to the control socket, and
+ * metrics
+ */
+func (rd *RuleDriver) recordChange(rec ChangeRecord) {
+	rd.control.Lock()
+	rd.control.lastChange = rec
+	rd.control.Unlock()
+
+	rd.metrics.observeChange(rec)
+}
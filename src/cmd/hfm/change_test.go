@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "bytes"
+import "io/ioutil"
+import "os"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+/* run a rule to completion, with metrics, change commands included */
+func runChangeRule(t *testing.T, cfg string) (*RuleDriver, string) {
+	var c Configuration
+	var buf bytes.Buffer
+
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	m := NewMetrics()
+	ruleDone := make(chan *RuleDriver)
+
+	driver := NewRuleDriver(*c.Rules["default"], ruleDone, 0)
+	driver.metrics = m.rule("default", "")
+	go driver.Run()
+	<-ruleDone
+
+	m.Expose(&buf)
+
+	return driver, buf.String()
+}
+
+func TestChangeExitStatus(t *testing.T) {
+	driver, out := runChangeRule(t, `runs=1; test="false"; change_fail="/bin/sh"; change_fail_arguments=["-c", "exit 4"]`)
+
+	c := driver.Snapshot().LastChange
+	if c.State != RuleStateFail || c.ExitStatus != 4 || c.Error == "" || c.RunUid != "default:1" || c.Duration <= 0 {
+		t.Errorf("Received unexpected change record: %+v", c)
+	}
+
+	if !strings.Contains(out, `hfm_rule_change_commands_total{rule="default",group="",state="fail",result="fail"} 1`+"\n") {
+		t.Errorf("Expected a failed change command in metrics, got:\n%s", out)
+	}
+}
+
+func TestChangeStartFailure(t *testing.T) {
+	driver, _ := runChangeRule(t, `runs=1; test="true"; change_success="/nonexistent/hfm-change"`)
+
+	if c := driver.Snapshot().LastChange; c.ExitStatus != -1 || c.Error == "" {
+		t.Errorf("Received unexpected change record: %+v", c)
+	}
+}
+
+func TestChangeTimeoutKill(t *testing.T) {
+	start := time.Now()
+
+	driver, out := runChangeRule(t, `runs=1; test="false"; change_fail="sleep"; change_fail_arguments="10"; change_timeout_kill=50ms`)
+
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the change command to be killed, took %v", time.Since(start))
+	}
+
+	if c := driver.Snapshot().LastChange; !c.Killed || c.ExitStatus == 0 {
+		t.Errorf("Received unexpected change record: %+v", c)
+	}
+
+	if !strings.Contains(out, `hfm_rule_change_timeouts_total{rule="default",group="",signal="kill"} 1`+"\n") {
+		t.Errorf("Expected a change command timeout in metrics, got:\n%s", out)
+	}
+}
+
+/* a driver whose change commands log their start, and end to a file */
+func newLoggingChangeDriver(t *testing.T, cfg string, logFile string) *RuleDriver {
+	var c Configuration
+
+	script := `echo $HFM_RULE $HFM_NEW_STATE start >> ` + logFile + `; sleep 0.2; echo $HFM_RULE $HFM_NEW_STATE end >> ` + logFile
+
+	cfg += `; test="true"; change_fail="/bin/sh"; change_fail_arguments=["-c", "` + script + `"]; change_success="/bin/sh"; change_success_arguments=["-c", "` + script + `"]`
+	if e := c.SetConfiguration(`r1 { ` + cfg + ` }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	return NewRuleDriver(*c.Rules["r1"], nil, 0)
+}
+
+func readChangeLog(t *testing.T, logFile string) []string {
+	out, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Could not read change log: %v", err)
+	}
+
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func TestChangeSerializeCoalesce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver := newLoggingChangeDriver(t, `change_serialize=true`, dir+"/log")
+
+	// flaps while the first command runs, only the last should follow it
+	for _, state := range []RuleStateType{RuleStateFail, RuleStateSuccess, RuleStateFail, RuleStateSuccess} {
+		driver.startChange(driver.newChangeRequest(state, driver.changeEnv(RuleStateUnknown, state)))
+	}
+	driver.children.changes.Wait()
+
+	expected := []string{"r1 fail start", "r1 fail end", "r1 success start", "r1 success end"}
+	if got := readChangeLog(t, dir+"/log"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected change commands %v, got: %v", expected, got)
+	}
+}
+
+func TestChangeSerializeRedundant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver := newLoggingChangeDriver(t, `change_serialize=true`, dir+"/log")
+
+	// back where it started by the time the first command completes
+	for _, state := range []RuleStateType{RuleStateFail, RuleStateSuccess, RuleStateFail} {
+		driver.startChange(driver.newChangeRequest(state, driver.changeEnv(RuleStateUnknown, state)))
+	}
+	driver.children.changes.Wait()
+
+	expected := []string{"r1 fail start", "r1 fail end"}
+	if got := readChangeLog(t, dir+"/log"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected change commands %v, got: %v", expected, got)
+	}
+}
+
+func TestChangeNamedLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d1 := newLoggingChangeDriver(t, `change_lock="pf"`, dir+"/log")
+	d2 := newLoggingChangeDriver(t, `change_lock="pf"`, dir+"/log")
+	d2.Rule.Name = "r2"
+
+	d1.startChange(d1.newChangeRequest(RuleStateFail, d1.changeEnv(RuleStateUnknown, RuleStateFail)))
+	d2.startChange(d2.newChangeRequest(RuleStateFail, d2.changeEnv(RuleStateUnknown, RuleStateFail)))
+	d1.children.changes.Wait()
+	d2.children.changes.Wait()
+
+	got := readChangeLog(t, dir+"/log")
+	if len(got) != 4 {
+		t.Fatalf("Expected 4 lines of change commands, got: %v", got)
+	}
+
+	// each command runs to completion before the other starts
+	for i := 0; i < 4; i += 2 {
+		if strings.TrimSuffix(got[i], " start") != strings.TrimSuffix(got[i+1], " end") {
+			t.Errorf("Expected change commands not to overlap, got: %v", got)
+		}
+	}
+}
+
+func TestChangeRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// fails until the third try
+	script := `echo >> ` + dir + `/tries; [ $(wc -l < ` + dir + `/tries) -ge 3 ]`
+
+	driver, _ := runChangeRule(t, `runs=1; test="false"; change_fail="/bin/sh"; change_fail_arguments=["-c", "`+script+`"]; change_retries=3; change_retry_interval=10ms; change_retry_backoff=true`)
+
+	s := driver.Snapshot()
+	if s.LastChange.Attempt != 3 || s.LastChange.ExitStatus != 0 || s.ChangePending || s.ChangeFailed {
+		t.Errorf("Expected success on the third try, received: %+v, pending: %v, failed: %v", s.LastChange, s.ChangePending, s.ChangeFailed)
+	}
+}
+
+func TestChangeRetriesGiveUp(t *testing.T) {
+	driver, out := runChangeRule(t, `runs=1; test="false"; change_fail="false"; change_retries=2; change_retry_interval=10ms`)
+
+	s := driver.Snapshot()
+	if s.LastChange.Attempt != 3 || s.ChangePending || !s.ChangeFailed {
+		t.Errorf("Expected to give up after the third try, received: %+v, pending: %v, failed: %v", s.LastChange, s.ChangePending, s.ChangeFailed)
+	}
+
+	if !strings.Contains(out, `hfm_rule_change_commands_total{rule="default",group="",state="fail",result="fail"} 3`+"\n") {
+		t.Errorf("Expected 3 failed change commands in metrics, got:\n%s", out)
+	}
+}
+
+func TestChangeRetriesAlways(t *testing.T) {
+	// every run repeats the state, and runs the change command again
+	_, out := runChangeRule(t, `runs=3; interval=1ms; test="true"; status="always-fail"; change_fail="false"; change_retries=2; change_retry_interval=10ms`)
+
+	if !strings.Contains(out, `hfm_rule_change_commands_total{rule="default",group="",state="fail",result="fail"} 9`+"\n") {
+		t.Errorf("Expected each change command to be retried, 9 failed in metrics, got:\n%s", out)
+	}
+}
+
+func TestChangeRetriesAbandoned(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`test="false"; change_fail="false"; change_retries=5; change_retry_interval=10s`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	driver := NewRuleDriver(*c.Rules["default"], nil, 0)
+	start := time.Now()
+
+	driver.changeState.transition(RuleStateFail, true)
+	driver.startChange(driver.newChangeRequest(RuleStateFail, nil))
+
+	// wait for the first try to fail, then recover
+	for driver.Snapshot().LastChange.Attempt == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if s := driver.Snapshot(); !s.ChangePending {
+		t.Errorf("Expected the change to be pending a retry")
+	}
+
+	driver.changeState.transition(RuleStateSuccess, false)
+	driver.children.changes.Wait()
+
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected retries to be abandoned, took %v", time.Since(start))
+	}
+
+	if s := driver.Snapshot(); s.LastChange.Attempt != 1 || s.ChangePending || s.ChangeFailed {
+		t.Errorf("Received unexpected change state: %+v, pending: %v, failed: %v", s.LastChange, s.ChangePending, s.ChangeFailed)
+	}
+}
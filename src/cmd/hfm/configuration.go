@@ -32,6 +32,8 @@ package main
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -43,14 +45,51 @@ import "github.com/mitchellh/go-libucl"
 
 // whether the following Rule fields were found when parsing the configuration
 type RuleFound struct {
-	Interval              bool
-	IntervalFail          bool
-	StartDelay            bool
-	TimeoutInt            bool
-	TimeoutKill           bool
-	Runs                  bool
-	ChangeFailDebounce    bool
-	ChangeSuccessDebounce bool
+	Interval                bool
+	IntervalFail            bool
+	IntervalFailMax         bool
+	IntervalFailMultiplier  bool
+	IntervalWarning         bool
+	SuccessExitCodes        bool
+	WarningExitCodes        bool
+	UnknownExitCodes        bool
+	FailExitCodes           bool
+	StartDelay              bool
+	Jitter                  bool
+	JitterTicks             bool
+	JitterSeed              bool
+	TimeoutInt              bool
+	TimeoutKill             bool
+	Runs                    bool
+	GroupMaxConcurrentTests bool
+	ChangeFailDebounce      bool
+	ChangeSuccessDebounce   bool
+	ChangeWarningDebounce   bool
+	ConnectTimeout          bool
+	MaxResponseTime         bool
+	TLSSkipVerify           bool
+	TLSExpiryWindow         bool
+	ClearEnvironment        bool
+	ChangeTimeoutInt        bool
+	ChangeTimeoutKill       bool
+	ChangeSerialize         bool
+	ChangeRetries           bool
+	ChangeRetryInterval     bool
+	ChangeRetryBackoff      bool
+	ChangeOnRestore         bool
+	DependsMode             bool
+	TimeoutState            bool
+	OutputLimit             bool
+	SuccessMatch            bool
+	FailMatch               bool
+	DependsRecovery         bool
+}
+
+/* settings that are objects, rather than child rules */
+var mapFields = map[string]bool{
+	"headers":        true,
+	"expect_headers": true,
+	"environment":    true,
 }
 
 /* How far we are nested into the config */
@@ -67,6 +106,9 @@ type Configuration struct {
 	/* path to configuration file, may be empty */
 	path string
 
+	/* how many test processes may run at once, 0 for no limit */
+	MaxConcurrentTests int
+
 	/* set of the rules parsed from the config, string maps to rule name */
 	Rules map[string]*Rule
 
@@ -159,6 +201,8 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 		config.ruleFinds = make(map[string]*RuleFound)
 		config.ruleDefaults = make(map[string]*Rule)
 		config.Rules = make(map[string]*Rule)
+		config.RulesOrder = nil
+		config.MaxConcurrentTests = 0
 	}
 
 	name, err := config.buildName(uclConfig, parentRule, depth)
@@ -168,8 +212,10 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 
 	var nextDepth ConfigLevelType
 
-	/* all actual rules have a test, defaults do not */
-	isRule := (uclConfig.Get("test") != nil)
+	/* all actual rules have a test, or a native test type, defaults do
+	 * not
+	 */
+	isRule := (uclConfig.Get("test") != nil || uclConfig.Get("test_type") != nil)
 
 	switch depth {
 	case ConfigLevelRoot:
@@ -178,7 +224,7 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 		nextDepth = ConfigLevelRule
 	case ConfigLevelRule:
 		if !isRule {
-			return fmt.Errorf("%s: a 'test' value must exist for rules", name)
+			return fmt.Errorf("%s: a 'test' or 'test_type' value must exist for rules", name)
 		}
 	}
 
@@ -200,10 +246,12 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 		defer c.Close()
 		field := strings.ToLower(c.Key())
 
-		if c.Type() == libucl.ObjectTypeObject {
+		if c.Type() == libucl.ObjectTypeObject && !mapFields[field] {
 			/* if we are a rule, we stop parsing children */
 			if depth != ConfigLevelRule || !isRule {
-				config.walkConfiguration(c, name, nextDepth)
+				if e := config.walkConfiguration(c, name, nextDepth); e != nil {
+					return e
+				}
 			} else {
 				return fmt.Errorf("%s: '%s' rules cannot contain child rules", name, field)
 			}
@@ -217,19 +265,158 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
 			}
 
-			switch strings.ToLower(c.ToString()) {
-			case "enabled":
-				rule.Status = RuleStatusEnabled
-			case "disabled":
-				rule.Status = RuleStatusDisabled
-			case "always-fail":
-				rule.Status = RuleStatusAlwaysFail
-			case "always-success":
-				rule.Status = RuleStatusAlwaysSuccess
+			status, ok := ParseRuleStatus(c.ToString())
+			if !ok {
+				return fmt.Errorf("%s: '%s' does not contain a valid string", name, field)
+			}
+
+			rule.Status = status
+		case "test_type":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			testType, ok := ParseRuleTestType(c.ToString())
+			if !ok {
+				return fmt.Errorf("%s: '%s' does not contain a valid string", name, field)
+			}
+
+			rule.TestType = testType
+		case "test_mode":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			testMode, ok := ParseRuleTestMode(c.ToString())
+			if !ok {
+				return fmt.Errorf("%s: '%s' does not contain a valid string", name, field)
+			}
+
+			rule.TestMode = testMode
+		case "schedule", "timezone":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			switch field {
+			case "schedule":
+				rule.Schedule = c.ToString()
+			case "timezone":
+				rule.Timezone = c.ToString()
+			}
+		case "jitter":
+			switch c.Type() {
+			case libucl.ObjectTypeInt, libucl.ObjectTypeFloat, libucl.ObjectTypeTime:
+				rule.Jitter = time.Duration(c.ToFloat() * float64(time.Second))
+				rule.JitterPercent = 0
+			case libucl.ObjectTypeString:
+				tmp := c.ToString()
+				if !strings.HasSuffix(tmp, "%") {
+					return fmt.Errorf("%s: '%s' must be an interval, or a percentage", name, field)
+				}
+
+				percent, e := strconv.ParseFloat(strings.TrimSuffix(tmp, "%"), 64)
+				if e != nil || percent < 0 || percent > 100 {
+					return fmt.Errorf("%s: '%s' must be a percentage in 0..100", name, field)
+				}
+
+				rule.Jitter = 0
+				rule.JitterPercent = percent
+			default:
+				return fmt.Errorf("%s: '%s' must be an interval, or a percentage, got type %v", name, field, c.Type())
+			}
+
+			ruleFound.Jitter = true
+		case "jitter_seed":
+			if c.Type() != libucl.ObjectTypeInt {
+				return fmt.Errorf("%s: '%s' must be an integer type, got type %v", name, field, c.Type())
+			}
+
+			rule.JitterSeed = c.ToInt()
+			ruleFound.JitterSeed = true
+		case "interval_fail_multiplier":
+			switch c.Type() {
+			case libucl.ObjectTypeInt, libucl.ObjectTypeFloat:
 			default:
+				return fmt.Errorf("%s: '%s' must be a valid numeric type, got type %v", name, field, c.Type())
+			}
+
+			if c.ToFloat() < 1 {
+				return fmt.Errorf("%s: '%s' must be at least 1", name, field)
+			}
+
+			rule.IntervalFailMultiplier = c.ToFloat()
+			ruleFound.IntervalFailMultiplier = true
+		case "aggregate":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			aggregate, ok := ParseRuleAggregate(c.ToString())
+			if !ok {
+				return fmt.Errorf("%s: '%s' does not contain a valid string", name, field)
+			}
+
+			rule.Aggregate = aggregate
+		case "aggregate_expression":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			if _, e := parseAggregateExpression(c.ToString()); e != nil {
+				return fmt.Errorf("%s: '%s' is not a valid expression: %v", name, field, e)
+			}
+
+			rule.AggregateExpression = c.ToString()
+		case "output_limit":
+			if c.Type() != libucl.ObjectTypeInt {
+				return fmt.Errorf("%s: '%s' must be an integer type, got type %v", name, field, c.Type())
+			}
+
+			if c.ToInt() < 0 {
+				return fmt.Errorf("%s: '%s' must not be negative", name, field)
+			}
+
+			rule.OutputLimit = int(c.ToInt())
+			ruleFound.OutputLimit = true
+		case "timeout_state":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			state, ok := ParseRuleTimeoutState(c.ToString())
+			if !ok {
+				return fmt.Errorf("%s: '%s' does not contain a valid string", name, field)
+			}
+
+			rule.TimeoutState = state
+			ruleFound.TimeoutState = true
+		case "depends_mode":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			mode, ok := ParseRuleDependsMode(c.ToString())
+			if !ok {
+				return fmt.Errorf("%s: '%s' does not contain a valid string", name, field)
+			}
+
+			rule.DependsMode = mode
+			ruleFound.DependsMode = true
+		case "depends_recovery":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			recovery, ok := ParseRuleDependsRecovery(c.ToString())
+			if !ok {
 				return fmt.Errorf("%s: '%s' does not contain a valid string", name, field)
 			}
-		case "start_delay", "interval", "interval_fail", "timeout_int", "timeout_kill":
+
+			rule.DependsRecovery = recovery
+			ruleFound.DependsRecovery = true
+		case "start_delay", "interval", "interval_fail", "interval_fail_max", "interval_warning", "timeout_int", "timeout_kill", "connect_timeout", "max_response_time", "tls_expiry_window",
+			"change_timeout_int", "change_timeout_kill", "change_retry_interval":
 			tmp := time.Duration(0)
 			/* interval/duration fields */
 			switch c.Type() {
@@ -250,15 +437,41 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 			case "interval_fail":
 				rule.IntervalFail = tmp
 				ruleFound.IntervalFail = true
+			case "interval_fail_max":
+				rule.IntervalFailMax = tmp
+				ruleFound.IntervalFailMax = true
+			case "interval_warning":
+				rule.IntervalWarning = tmp
+				ruleFound.IntervalWarning = true
 			case "timeout_int":
 				rule.TimeoutInt = tmp
 				ruleFound.TimeoutInt = true
 			case "timeout_kill":
 				rule.TimeoutKill = tmp
 				ruleFound.TimeoutKill = true
+			case "connect_timeout":
+				rule.ConnectTimeout = tmp
+				ruleFound.ConnectTimeout = true
+			case "max_response_time":
+				rule.MaxResponseTime = tmp
+				ruleFound.MaxResponseTime = true
+			case "tls_expiry_window":
+				rule.TLSExpiryWindow = tmp
+				ruleFound.TLSExpiryWindow = true
+			case "change_timeout_int":
+				rule.ChangeTimeoutInt = tmp
+				ruleFound.ChangeTimeoutInt = true
+			case "change_timeout_kill":
+				rule.ChangeTimeoutKill = tmp
+				ruleFound.ChangeTimeoutKill = true
+			case "change_retry_interval":
+				rule.ChangeRetryInterval = tmp
+				ruleFound.ChangeRetryInterval = true
 			}
-		case "test", "change_fail", "change_success":
-			/* command fields */
+		case "test", "change_fail", "change_success", "change_warning", "address", "send", "expect",
+			"url", "method", "body", "body_match", "success_match", "fail_match", "body_contains", "tls_ca", "tls_cert", "tls_key",
+			"dns_server", "dns_name", "tls_server_name", "change_lock":
+			/* command, and other string fields */
 			if c.Type() != libucl.ObjectTypeString {
 				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
 			}
@@ -271,8 +484,190 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 				rule.ChangeFail = tmp
 			case "change_success":
 				rule.ChangeSuccess = tmp
+			case "change_warning":
+				rule.ChangeWarning = tmp
+			case "address":
+				rule.Address = tmp
+			case "send":
+				rule.Send = tmp
+			case "expect":
+				rule.Expect = tmp
+			case "url":
+				rule.URL = tmp
+			case "method":
+				rule.Method = strings.ToUpper(tmp)
+			case "body":
+				rule.Body = tmp
+			case "body_match":
+				re, e := regexp.Compile(tmp)
+				if e != nil {
+					return fmt.Errorf("%s: '%s' is not a valid regular expression: %v", name, field, e)
+				}
+				rule.BodyMatch = re
+			case "success_match", "fail_match":
+				/* empty to not match on the output, where a group does */
+				var re *regexp.Regexp
+				if tmp != "" {
+					var e error
+					if re, e = regexp.Compile(tmp); e != nil {
+						return fmt.Errorf("%s: '%s' is not a valid regular expression: %v", name, field, e)
+					}
+				}
+
+				if field == "success_match" {
+					rule.SuccessMatch = re
+					ruleFound.SuccessMatch = true
+				} else {
+					rule.FailMatch = re
+					ruleFound.FailMatch = true
+				}
+			case "body_contains":
+				rule.BodyContains = tmp
+			case "tls_ca":
+				rule.TLSCA = tmp
+			case "tls_cert":
+				rule.TLSCert = tmp
+			case "tls_key":
+				rule.TLSKey = tmp
+			case "dns_server":
+				rule.DNSServer = tmp
+			case "dns_name":
+				rule.DNSName = tmp
+			case "tls_server_name":
+				rule.TLSServerName = tmp
+			case "change_lock":
+				rule.ChangeLock = tmp
+			}
+		case "dns_protocol":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			tmp := strings.ToLower(c.ToString())
+			if tmp != "udp" && tmp != "tcp" {
+				return fmt.Errorf("%s: '%s' must be udp, or tcp", name, field)
+			}
+
+			rule.DNSProtocol = tmp
+		case "dns_type":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			tmp := strings.ToUpper(c.ToString())
+			if _, ok := dnsTypes[tmp]; !ok {
+				return fmt.Errorf("%s: '%s' is not a supported record type", name, field)
+			}
+
+			rule.DNSType = tmp
+		case "expect_rcode":
+			if c.Type() != libucl.ObjectTypeString {
+				return fmt.Errorf("%s: '%s' must be a string type, got type %v", name, field, c.Type())
+			}
+
+			tmp, ok := dnsRcodes[strings.ToUpper(c.ToString())]
+			if !ok {
+				return fmt.Errorf("%s: '%s' is not a recognized response code", name, field)
+			}
+
+			rule.ExpectRcode = tmp
+		case "expect_answers_exact":
+			if c.Type() != libucl.ObjectTypeBoolean {
+				return fmt.Errorf("%s: '%s' must be a boolean type, got type %v", name, field, c.Type())
+			}
+
+			rule.ExpectAnswersExact = c.ToBool()
+		case "min_answers":
+			if c.Type() != libucl.ObjectTypeInt {
+				return fmt.Errorf("%s: '%s' must be an integer type, got type %v", name, field, c.Type())
+			}
+
+			tmp := c.ToInt()
+			if tmp < 0 || tmp > 65535 {
+				return fmt.Errorf("%s: '%s' must be in 0..65535", name, field)
+			}
+
+			rule.MinAnswers = uint16(tmp)
+		case "headers", "expect_headers", "environment":
+			if c.Type() != libucl.ObjectTypeObject {
+				return fmt.Errorf("%s: '%s' must be an object type, got type %v", name, field, c.Type())
+			}
+
+			tmp, e := parseStringMap(c, name, field)
+			if e != nil {
+				return e
+			}
+
+			switch field {
+			case "headers":
+				rule.Headers = tmp
+			case "expect_headers":
+				rule.ExpectHeaders = tmp
+			case "environment":
+				rule.Environment = tmp
+			}
+		case "change_serialize", "change_retry_backoff", "change_on_restore", "jitter_ticks":
+			if c.Type() != libucl.ObjectTypeBoolean {
+				return fmt.Errorf("%s: '%s' must be a boolean type, got type %v", name, field, c.Type())
+			}
+
+			switch field {
+			case "change_serialize":
+				rule.ChangeSerialize = c.ToBool()
+				ruleFound.ChangeSerialize = true
+			case "change_retry_backoff":
+				rule.ChangeRetryBackoff = c.ToBool()
+				ruleFound.ChangeRetryBackoff = true
+			case "change_on_restore":
+				rule.ChangeOnRestore = c.ToBool()
+				ruleFound.ChangeOnRestore = true
+			case "jitter_ticks":
+				rule.JitterTicks = c.ToBool()
+				ruleFound.JitterTicks = true
+			}
+		case "clear_environment":
+			if c.Type() != libucl.ObjectTypeBoolean {
+				return fmt.Errorf("%s: '%s' must be a boolean type, got type %v", name, field, c.Type())
+			}
+
+			rule.ClearEnvironment = c.ToBool()
+			ruleFound.ClearEnvironment = true
+		case "expect_status":
+			tmp, e := parseStatusRanges(c, name, field)
+			if e != nil {
+				return e
+			}
+
+			rule.ExpectStatus = tmp
+		case "success_exit_codes", "warning_exit_codes", "unknown_exit_codes", "fail_exit_codes":
+			tmp, e := parseExitCodeRanges(c, name, field)
+			if e != nil {
+				return e
 			}
-		case "test_arguments", "change_fail_arguments", "change_success_arguments":
+
+			/* an empty array overrides a group's */
+			switch field {
+			case "success_exit_codes":
+				rule.SuccessExitCodes = tmp
+				ruleFound.SuccessExitCodes = true
+			case "warning_exit_codes":
+				rule.WarningExitCodes = tmp
+				ruleFound.WarningExitCodes = true
+			case "unknown_exit_codes":
+				rule.UnknownExitCodes = tmp
+				ruleFound.UnknownExitCodes = true
+			case "fail_exit_codes":
+				rule.FailExitCodes = tmp
+				ruleFound.FailExitCodes = true
+			}
+		case "tls_skip_verify":
+			if c.Type() != libucl.ObjectTypeBoolean {
+				return fmt.Errorf("%s: '%s' must be a boolean type, got type %v", name, field, c.Type())
+			}
+
+			rule.TLSSkipVerify = c.ToBool()
+			ruleFound.TLSSkipVerify = true
+		case "test_arguments", "change_fail_arguments", "change_success_arguments", "change_warning_arguments", "expect_answers", "depends_on", "aggregate_rules", "maintenance":
 			tmp := []string{}
 			if c.Type() == libucl.ObjectTypeString {
 				tmp = append(tmp, c.ToString())
@@ -302,8 +697,18 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 				rule.ChangeFailArguments = tmp
 			case "change_success_arguments":
 				rule.ChangeSuccessArguments = tmp
+			case "change_warning_arguments":
+				rule.ChangeWarningArguments = tmp
+			case "expect_answers":
+				rule.ExpectAnswers = tmp
+			case "depends_on":
+				rule.DependsOn = tmp
+			case "aggregate_rules":
+				rule.AggregateRules = tmp
+			case "maintenance":
+				rule.Maintenance = tmp
 			}
-		case "runs":
+		case "runs", "change_retries", "aggregate_fail_count", "max_concurrent_tests", "group_max_concurrent_tests":
 			if c.Type() != libucl.ObjectTypeInt {
 				return fmt.Errorf("%s: '%s' must be an integer type, got type %v", name, field, c.Type())
 			}
@@ -313,9 +718,30 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 				return fmt.Errorf("%s: '%s' must be in 0..65535", name, field)
 			}
 
-			rule.Runs = uint16(tmp)
-			ruleFound.Runs = true
-		case "change_fail_debounce", "change_success_debounce":
+			switch field {
+			case "runs":
+				rule.Runs = uint16(tmp)
+				ruleFound.Runs = true
+			case "change_retries":
+				rule.ChangeRetries = uint16(tmp)
+				ruleFound.ChangeRetries = true
+			case "aggregate_fail_count":
+				rule.AggregateFailCount = uint16(tmp)
+			case "max_concurrent_tests":
+				if depth != ConfigLevelRoot {
+					return fmt.Errorf("%s: '%s' may only be set at the top level", name, field)
+				}
+
+				config.MaxConcurrentTests = int(tmp)
+			case "group_max_concurrent_tests":
+				if isRule {
+					return fmt.Errorf("%s: '%s' may only be set on groups", name, field)
+				}
+
+				rule.GroupMaxConcurrentTests = uint16(tmp)
+				ruleFound.GroupMaxConcurrentTests = true
+			}
+		case "change_fail_debounce", "change_success_debounce", "change_warning_debounce":
 			if c.Type() != libucl.ObjectTypeInt {
 				return fmt.Errorf("%s: '%s' must be an integer type, got type %v", name, field, c.Type())
 			}
@@ -333,6 +759,9 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 			case "change_success_debounce":
 				rule.ChangeSuccessDebounce = uint16(tmp)
 				ruleFound.ChangeSuccessDebounce = true
+			case "change_warning_debounce":
+				rule.ChangeWarningDebounce = uint16(tmp)
+				ruleFound.ChangeWarningDebounce = true
 			}
 
 		default:
@@ -341,7 +770,132 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 	}
 
 	if depth == ConfigLevelRoot {
-		config.resolveDefaults()
+		return config.resolveDefaults()
+	}
+
+	return nil
+}
+
+/* an object of string values */
+func parseStringMap(c *libucl.Object, name string, field string) (map[string]string, error) {
+	tmp := make(map[string]string)
+
+	j := c.Iterate(true)
+	defer j.Close()
+
+	for v := j.Next(); v != nil; v = j.Next() {
+		defer v.Close()
+
+		if v.Type() != libucl.ObjectTypeString {
+			return nil, fmt.Errorf("%s: '%s' must contain only string values, got type %v for '%s'", name, field, v.Type(), v.Key())
+		}
+
+		tmp[v.Key()] = v.ToString()
+	}
+
+	return tmp, nil
+}
+
+/* a status code (200), or range of status codes (200-299), or an array of
+ * either
+ */
+func parseStatusRanges(c *libucl.Object, name string, field string) ([][2]int, error) {
+	return parseCodeRanges(c, name, field, "status codes")
+}
+
+/* an exit code (2), or range of exit codes (2-3), or an array of either */
+func parseExitCodeRanges(c *libucl.Object, name string, field string) ([][2]int, error) {
+	return parseCodeRanges(c, name, field, "exit codes")
+}
+
+/* a code, or range of codes, or an array of either, described in errors as
+ * codes
+ */
+func parseCodeRanges(c *libucl.Object, name string, field string, codes string) ([][2]int, error) {
+	var tmp [][2]int
+
+	parse := func(v *libucl.Object) error {
+		switch v.Type() {
+		case libucl.ObjectTypeInt:
+			code := int(v.ToInt())
+			tmp = append(tmp, [2]int{code, code})
+			return nil
+		case libucl.ObjectTypeString:
+			parts := strings.SplitN(v.ToString(), "-", 2)
+			low, e := strconv.Atoi(strings.TrimSpace(parts[0]))
+			if e != nil {
+				break
+			}
+
+			high := low
+			if len(parts) == 2 {
+				if high, e = strconv.Atoi(strings.TrimSpace(parts[1])); e != nil || high < low {
+					break
+				}
+			}
+
+			tmp = append(tmp, [2]int{low, high})
+			return nil
+		}
+
+		return fmt.Errorf("%s: '%s' must contain %s, or ranges of %s, got '%s'", name, field, codes, codes, v.ToString())
+	}
+
+	if c.Type() == libucl.ObjectTypeArray {
+		j := c.Iterate(true)
+		defer j.Close()
+
+		for v := j.Next(); v != nil; v = j.Next() {
+			defer v.Close()
+
+			if e := parse(v); e != nil {
+				return nil, e
+			}
+		}
+	} else if e := parse(c); e != nil {
+		return nil, e
+	}
+
+	return tmp, nil
+}
+
+/* make sure a rule has what its test type needs to run */
+func validateTest(rule Rule) error {
+	if rule.TestMode == RuleTestModeCoprocess && rule.TestType != RuleTestExec {
+		return fmt.Errorf("%s: 'test_mode' coprocess is only valid for exec tests", rule.Name)
+	}
+
+	switch rule.TestType {
+	case RuleTestExec:
+		if rule.Test == "" {
+			return fmt.Errorf("%s: a 'test' value must exist for exec tests", rule.Name)
+		}
+	case RuleTestTCP, RuleTestTLS:
+		if rule.Address == "" {
+			return fmt.Errorf("%s: an 'address' value must exist for %v tests", rule.Name, rule.TestType)
+		}
+	case RuleTestHTTP:
+		if rule.URL == "" {
+			return fmt.Errorf("%s: a 'url' value must exist for %v tests", rule.Name, rule.TestType)
+		}
+	case RuleTestDNS:
+		if rule.DNSServer == "" || rule.DNSName == "" {
+			return fmt.Errorf("%s: 'dns_server' and 'dns_name' values must exist for %v tests", rule.Name, rule.TestType)
+		}
+	case RuleTestAggregate:
+		if rule.Aggregate == RuleAggregateExpression {
+			if rule.AggregateExpression == "" {
+				return fmt.Errorf("%s: an 'aggregate_expression' value must exist for expression aggregates", rule.Name)
+			}
+			break
+		}
+
+		if len(rule.AggregateRules) == 0 {
+			return fmt.Errorf("%s: an 'aggregate_rules' value must exist for %v aggregates", rule.Name, rule.Aggregate)
+		}
+		if int(rule.AggregateFailCount) > len(rule.AggregateRules) {
+			return fmt.Errorf("%s: 'aggregate_fail_count' must be at most the number of 'aggregate_rules'", rule.Name)
+		}
 	}
 
 	return nil
@@ -350,10 +904,12 @@ func (config *Configuration) walkConfiguration(uclConfig *libucl.Object, parentR
 /* take our set of raw parsed rules, and apply the group and root inherited,
  * and initial values
  */
-func (c *Configuration) resolveDefaults() {
+func (c *Configuration) resolveDefaults() error {
 	var f RuleFound
 
-	for _, rule := range c.Rules {
+	for _, name := range c.RulesOrder {
+		rule := c.Rules[name]
+
 		if tmp, ok := c.ruleFinds[rule.Name]; ok {
 			f = *tmp
 		} else {
@@ -381,6 +937,18 @@ func (c *Configuration) resolveDefaults() {
 			rule.IntervalFail = rule.Interval
 		}
 
+		if !f.IntervalWarning && rule.IntervalWarning == 0 {
+			rule.IntervalWarning = rule.Interval
+		}
+
+		if rule.IntervalFailMultiplier == 0 {
+			rule.IntervalFailMultiplier = 2
+		}
+
+		if rule.IntervalFailMax != 0 && rule.IntervalFailMax < rule.IntervalFail {
+			return fmt.Errorf("%s: 'interval_fail_max' must be at least 'interval_fail'", rule.Name)
+		}
+
 		/* these must be greater than zero */
 		if !f.ChangeFailDebounce && rule.ChangeFailDebounce == 0 {
 			rule.ChangeFailDebounce = 1
@@ -389,11 +957,104 @@ func (c *Configuration) resolveDefaults() {
 		if !f.ChangeSuccessDebounce && rule.ChangeSuccessDebounce == 0 {
 			rule.ChangeSuccessDebounce = 1
 		}
+
+		if !f.ChangeWarningDebounce && rule.ChangeWarningDebounce == 0 {
+			rule.ChangeWarningDebounce = 1
+		}
+
+		if !f.OutputLimit && rule.OutputLimit == 0 && (rule.SuccessMatch != nil || rule.FailMatch != nil) {
+			rule.OutputLimit = defaultOutputLimit
+		}
+
+		if !f.ChangeTimeoutKill && rule.ChangeTimeoutKill == 0 {
+			rule.ChangeTimeoutKill = defaultChangeTimeoutKill
+		}
+
+		/* only now do we know everything the test will run with */
+		if e := validateTest(*rule); e != nil {
+			return e
+		}
+
+		if rule.Schedule != "" {
+			if _, e := rule.schedule(); e != nil {
+				return fmt.Errorf("%s: 'schedule' is not valid: %v", rule.Name, e)
+			}
+
+			/* there's no interval for a percentage of */
+			if rule.JitterPercent != 0 {
+				return fmt.Errorf("%s: 'jitter' must be an interval with a 'schedule'", rule.Name)
+			}
+		}
+
+		if _, e := rule.maintenanceWindows(); e != nil {
+			return fmt.Errorf("%s: 'maintenance' is not valid: %v", rule.Name, e)
+		}
+	}
+
+	if e := c.validateDependencies(); e != nil {
+		return e
 	}
 
 	/* we don't need this book keeping around after this step */
 	c.ruleDefaults = nil
 	c.ruleFinds = nil
+
+	return nil
+}
+
+/* make sure every rule depended on, or aggregated exists, and that no rule
+ * refers to itself, however indirectly
+ */
+func (c *Configuration) validateDependencies() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	marks := make(map[string]int)
+	var path []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			/* the cycle is the path from where we first saw name */
+			for i := range path {
+				if path[i] == name {
+					return fmt.Errorf("%s: refers to itself: %s", name, strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		case visited:
+			return nil
+		}
+
+		marks[name] = visiting
+		path = append(path, name)
+
+		for _, dep := range c.Rules[name].references() {
+			if _, ok := c.Rules[dep]; !ok {
+				return fmt.Errorf("%s: refers to unknown rule '%s'", name, dep)
+			}
+
+			if e := visit(dep); e != nil {
+				return e
+			}
+		}
+
+		path = path[:len(path)-1]
+		marks[name] = visited
+
+		return nil
+	}
+
+	for _, name := range c.RulesOrder {
+		if e := visit(name); e != nil {
+			return e
+		}
+	}
+
+	return nil
 }
 
 /* apply inherited values to fields that haven't been explicitly set */
@@ -412,6 +1073,10 @@ func (c *Configuration) inheritValues(dst *Rule, src Rule, f *RuleFound) {
 		dst.Runs = src.Runs
 	}
 
+	if !f.GroupMaxConcurrentTests && dst.GroupMaxConcurrentTests == 0 {
+		dst.GroupMaxConcurrentTests = src.GroupMaxConcurrentTests
+	}
+
 	if !f.Interval && dst.Interval == 0 {
 		dst.Interval = src.Interval
 	}
@@ -420,10 +1085,59 @@ func (c *Configuration) inheritValues(dst *Rule, src Rule, f *RuleFound) {
 		dst.IntervalFail = src.IntervalFail
 	}
 
+	if !f.IntervalWarning && dst.IntervalWarning == 0 {
+		dst.IntervalWarning = src.IntervalWarning
+	}
+
+	if !f.SuccessExitCodes && dst.SuccessExitCodes == nil {
+		dst.SuccessExitCodes = src.SuccessExitCodes
+	}
+
+	if !f.WarningExitCodes && dst.WarningExitCodes == nil {
+		dst.WarningExitCodes = src.WarningExitCodes
+	}
+
+	if !f.UnknownExitCodes && dst.UnknownExitCodes == nil {
+		dst.UnknownExitCodes = src.UnknownExitCodes
+	}
+
+	if !f.FailExitCodes && dst.FailExitCodes == nil {
+		dst.FailExitCodes = src.FailExitCodes
+	}
+
+	if !f.IntervalFailMax && dst.IntervalFailMax == 0 {
+		dst.IntervalFailMax = src.IntervalFailMax
+	}
+
+	if !f.IntervalFailMultiplier && dst.IntervalFailMultiplier == 0 {
+		dst.IntervalFailMultiplier = src.IntervalFailMultiplier
+	}
+
 	if !f.StartDelay && dst.StartDelay == 0 {
 		dst.StartDelay = src.StartDelay
 	}
 
+	if dst.Schedule == "" {
+		dst.Schedule = src.Schedule
+	}
+
+	if dst.Timezone == "" {
+		dst.Timezone = src.Timezone
+	}
+
+	if !f.Jitter && dst.Jitter == 0 && dst.JitterPercent == 0 {
+		dst.Jitter = src.Jitter
+		dst.JitterPercent = src.JitterPercent
+	}
+
+	if !f.JitterTicks && !dst.JitterTicks {
+		dst.JitterTicks = src.JitterTicks
+	}
+
+	if !f.JitterSeed && dst.JitterSeed == 0 {
+		dst.JitterSeed = src.JitterSeed
+	}
+
 	if !f.TimeoutInt && dst.TimeoutInt == 0 {
 		dst.TimeoutInt = src.TimeoutInt
 	}
@@ -439,4 +1153,130 @@ func (c *Configuration) inheritValues(dst *Rule, src Rule, f *RuleFound) {
 	if !f.ChangeSuccessDebounce && dst.ChangeSuccessDebounce == 0 {
 		dst.ChangeSuccessDebounce = src.ChangeSuccessDebounce
 	}
+
+	if !f.ChangeWarningDebounce && dst.ChangeWarningDebounce == 0 {
+		dst.ChangeWarningDebounce = src.ChangeWarningDebounce
+	}
+
+	if !f.ConnectTimeout && dst.ConnectTimeout == 0 {
+		dst.ConnectTimeout = src.ConnectTimeout
+	}
+
+	if !f.MaxResponseTime && dst.MaxResponseTime == 0 {
+		dst.MaxResponseTime = src.MaxResponseTime
+	}
+
+	if !f.TLSExpiryWindow && dst.TLSExpiryWindow == 0 {
+		dst.TLSExpiryWindow = src.TLSExpiryWindow
+	}
+
+	if !f.TLSSkipVerify && !dst.TLSSkipVerify {
+		dst.TLSSkipVerify = src.TLSSkipVerify
+	}
+
+	if dst.TLSCA == "" {
+		dst.TLSCA = src.TLSCA
+	}
+
+	if dst.TLSCert == "" {
+		dst.TLSCert = src.TLSCert
+	}
+
+	if dst.TLSKey == "" {
+		dst.TLSKey = src.TLSKey
+	}
+
+	if dst.DNSServer == "" {
+		dst.DNSServer = src.DNSServer
+	}
+
+	if dst.DNSProtocol == "" {
+		dst.DNSProtocol = src.DNSProtocol
+	}
+
+	if !f.ChangeTimeoutInt && dst.ChangeTimeoutInt == 0 {
+		dst.ChangeTimeoutInt = src.ChangeTimeoutInt
+	}
+
+	if !f.ChangeTimeoutKill && dst.ChangeTimeoutKill == 0 {
+		dst.ChangeTimeoutKill = src.ChangeTimeoutKill
+	}
+
+	if !f.ChangeSerialize && !dst.ChangeSerialize {
+		dst.ChangeSerialize = src.ChangeSerialize
+	}
+
+	if !f.ChangeRetries && dst.ChangeRetries == 0 {
+		dst.ChangeRetries = src.ChangeRetries
+	}
+
+	if !f.ChangeRetryInterval && dst.ChangeRetryInterval == 0 {
+		dst.ChangeRetryInterval = src.ChangeRetryInterval
+	}
+
+	if !f.ChangeRetryBackoff && !dst.ChangeRetryBackoff {
+		dst.ChangeRetryBackoff = src.ChangeRetryBackoff
+	}
+
+	if !f.ChangeOnRestore && !dst.ChangeOnRestore {
+		dst.ChangeOnRestore = src.ChangeOnRestore
+	}
+
+	if dst.ChangeLock == "" {
+		dst.ChangeLock = src.ChangeLock
+	}
+
+	if dst.Maintenance == nil {
+		dst.Maintenance = src.Maintenance
+	}
+
+	if dst.DependsOn == nil {
+		dst.DependsOn = src.DependsOn
+	}
+
+	if !f.OutputLimit && dst.OutputLimit == 0 {
+		dst.OutputLimit = src.OutputLimit
+	}
+
+	if !f.SuccessMatch && dst.SuccessMatch == nil {
+		dst.SuccessMatch = src.SuccessMatch
+	}
+
+	if !f.FailMatch && dst.FailMatch == nil {
+		dst.FailMatch = src.FailMatch
+	}
+
+	if !f.TimeoutState && dst.TimeoutState == RuleTimeoutStateExit {
+		dst.TimeoutState = src.TimeoutState
+	}
+
+	if !f.DependsMode && dst.DependsMode == RuleDependsSuppress {
+		dst.DependsMode = src.DependsMode
+	}
+
+	if !f.DependsRecovery && dst.DependsRecovery == RuleRecoveryReconcile {
+		dst.DependsRecovery = src.DependsRecovery
+	}
+
+	if !f.ClearEnvironment && !dst.ClearEnvironment {
+		dst.ClearEnvironment = src.ClearEnvironment
+	}
+
+	/* maps are merged, the closest to the rule wins */
+	dst.Headers = mergeStringMap(dst.Headers, src.Headers)
+	dst.Environment = mergeStringMap(dst.Environment, src.Environment)
+}
+
+/* add the keys of src that dst doesn't have */
+func mergeStringMap(dst map[string]string, src map[string]string) map[string]string {
+	for k, v := range src {
+		if _, ok := dst[k]; !ok {
+			if dst == nil {
+				dst = make(map[string]string)
+			}
+			dst[k] = v
+		}
+	}
+
+	return dst
 }
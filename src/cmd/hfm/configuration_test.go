@@ -31,6 +31,7 @@ package main
 import (
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -370,3 +371,293 @@ g3 {
 		i++
 	}
 }
+
+func TestConfigTestTypeTCP(t *testing.T) {
+	var c Configuration
+
+	cfg := `
+connect_timeout=2
+g1 {
+	r1 {
+		test_type="tcp"
+		address="127.0.0.1:22"
+		send="ping"
+		expect="pong"
+	}
+}`
+
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Errorf("Received error for tcp config: %v", e)
+	}
+
+	rule, ok := c.Rules["g1/r1"]
+	if !ok || rule.TestType != RuleTestTCP || rule.Address != "127.0.0.1:22" || rule.Send != "ping" || rule.Expect != "pong" {
+		t.Errorf("Received unexpected rule: %+v", rule)
+	}
+
+	if rule.ConnectTimeout != time.Second*2 {
+		t.Errorf("Expected inherited connect_timeout, received: %v", rule.ConnectTimeout)
+	}
+
+	if e := c.SetConfiguration(`r1 { test_type="tcp" }`); e == nil {
+		t.Errorf("Expected error for tcp test without an address")
+	}
+
+	if e := c.SetConfiguration(`r1 { test_type="bogus"; address="127.0.0.1:22" }`); e == nil {
+		t.Errorf("Expected error for unrecognized test type")
+	}
+}
+
+func TestConfigTestTypeHTTP(t *testing.T) {
+	var c Configuration
+
+	cfg := `
+tls_skip_verify=true
+headers { Authorization="Bearer abc"; X-Group="root" }
+g1 {
+	max_response_time=500ms
+	r1 {
+		test_type="http"
+		url="https://127.0.0.1/health"
+		method="head"
+		headers { X-Group="r1" }
+		expect_status=[204, "300-399"]
+		body_match="^ok$"
+	}
+}`
+
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for http config: %v", e)
+	}
+
+	rule, ok := c.Rules["g1/r1"]
+	if !ok || rule.TestType != RuleTestHTTP || rule.URL != "https://127.0.0.1/health" || rule.Method != "HEAD" {
+		t.Fatalf("Received unexpected rule: %+v", rule)
+	}
+
+	if !rule.TLSSkipVerify || rule.MaxResponseTime != 500*time.Millisecond {
+		t.Errorf("Expected inherited tls_skip_verify and max_response_time, received: %+v", rule)
+	}
+
+	if rule.Headers["Authorization"] != "Bearer abc" || rule.Headers["X-Group"] != "r1" {
+		t.Errorf("Expected merged headers, received: %v", rule.Headers)
+	}
+
+	if len(rule.ExpectStatus) != 2 || rule.ExpectStatus[0] != [2]int{204, 204} || rule.ExpectStatus[1] != [2]int{300, 399} {
+		t.Errorf("Received unexpected expect_status: %v", rule.ExpectStatus)
+	}
+
+	if rule.BodyMatch == nil || !rule.BodyMatch.MatchString("ok") {
+		t.Errorf("Received unexpected body_match: %v", rule.BodyMatch)
+	}
+
+	if e := c.SetConfiguration(`r1 { test_type="http" }`); e == nil {
+		t.Errorf("Expected error for http test without a url")
+	}
+
+	if e := c.SetConfiguration(`r1 { test_type="http"; url="http://x/"; expect_status="200-1" }`); e == nil {
+		t.Errorf("Expected error for an invalid status range")
+	}
+
+	if e := c.SetConfiguration(`r1 { test_type="http"; url="http://x/"; body_match="(" }`); e == nil {
+		t.Errorf("Expected error for an invalid regular expression")
+	}
+}
+
+func TestConfigTestTypeDNS(t *testing.T) {
+	var c Configuration
+
+	cfg := `
+g1 {
+	dns_server="10.0.0.53"
+	dns_protocol="TCP"
+	r1 {
+		test_type="dns"
+		dns_name="example.com"
+		dns_type="aaaa"
+		expect_rcode="noerror"
+		expect_answers=["::1"]
+		min_answers=1
+	}
+	r2 {
+		test_type="dns"
+		dns_server="10.0.1.53:5353"
+		dns_name="example.com"
+	}
+}`
+
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for dns config: %v", e)
+	}
+
+	rule := c.Rules["g1/r1"]
+	if rule.TestType != RuleTestDNS || rule.DNSServer != "10.0.0.53" || rule.DNSProtocol != "tcp" || rule.DNSType != "AAAA" || rule.MinAnswers != 1 || len(rule.ExpectAnswers) != 1 {
+		t.Errorf("Received unexpected rule: %+v", rule)
+	}
+
+	if rule := c.Rules["g1/r2"]; rule.DNSServer != "10.0.1.53:5353" {
+		t.Errorf("Expected dns_server to be overridden, received: %v", rule.DNSServer)
+	}
+
+	if e := c.SetConfiguration(`r1 { test_type="dns"; dns_name="example.com" }`); e == nil {
+		t.Errorf("Expected error for dns test without a server")
+	}
+
+	if e := c.SetConfiguration(`r1 { test_type="dns"; dns_server="::1"; dns_name="example.com"; dns_type="bogus" }`); e == nil {
+		t.Errorf("Expected error for an unsupported record type")
+	}
+
+	if e := c.SetConfiguration(`r1 { test_type="dns"; dns_server="::1"; dns_name="example.com"; expect_rcode="bogus" }`); e == nil {
+		t.Errorf("Expected error for an unrecognized response code")
+	}
+}
+
+func TestConfigDependsOn(t *testing.T) {
+	var c Configuration
+
+	cfg := `
+switch { test="true" }
+hosts {
+	depends_on="switch"
+	depends_mode="pause"
+	r1 { test="true" }
+	r2 { test="true"; depends_on=["switch", "hosts/r1"]; depends_recovery="none" }
+}`
+
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for depends_on config: %v", e)
+	}
+
+	rule := c.Rules["hosts/r1"]
+	if !reflect.DeepEqual(rule.DependsOn, []string{"switch"}) || rule.DependsMode != RuleDependsPause || rule.DependsRecovery != RuleRecoveryReconcile {
+		t.Errorf("Received unexpected rule: %+v", rule)
+	}
+
+	rule = c.Rules["hosts/r2"]
+	if !reflect.DeepEqual(rule.DependsOn, []string{"switch", "hosts/r1"}) || rule.DependsMode != RuleDependsPause || rule.DependsRecovery != RuleRecoveryNone {
+		t.Errorf("Received unexpected rule: %+v", rule)
+	}
+
+	if e := c.SetConfiguration(`r1 { test="true"; depends_on="r2" }`); e == nil {
+		t.Errorf("Expected error for an unknown dependency")
+	}
+
+	if e := c.SetConfiguration(`r1 { test="true"; depends_on="r1" }`); e == nil {
+		t.Errorf("Expected error for a rule depending on itself")
+	}
+
+	e := c.SetConfiguration(`r1 { test="true"; depends_on="r2" } r2 { test="true"; depends_on="r3" } r3 { test="true"; depends_on="r1" }`)
+	if e == nil || !strings.Contains(e.Error(), "r1 -> r2 -> r3 -> r1") {
+		t.Errorf("Expected error naming the cycle, got: %v", e)
+	}
+
+	if e := c.SetConfiguration(`r1 { test="true"; depends_mode="bogus" }`); e == nil {
+		t.Errorf("Expected error for an unknown depends_mode")
+	}
+}
+
+func TestConfigAggregate(t *testing.T) {
+	var c Configuration
+
+	bad := []string{
+		`r { test_type="aggregate" }`,
+		`r { test_type="aggregate"; aggregate="expression" }`,
+		`a { test="true" } r { test_type="aggregate"; aggregate_rules="a"; aggregate_fail_count=2 }`,
+		`r { test_type="aggregate"; aggregate_rules="missing" }`,
+		`r { test_type="aggregate"; aggregate="expression"; aggregate_expression="missing || r" }`,
+		`r { test_type="aggregate"; aggregate="expression"; aggregate_expression="(r" }`,
+		`r { test_type="aggregate"; aggregate_rules="r" }`,
+	}
+
+	for _, cfg := range bad {
+		if e := c.SetConfiguration(cfg); e == nil {
+			t.Errorf("Expected error for config: %s", cfg)
+		}
+	}
+}
+
+func TestConfigIntervalFailMax(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`g1 { interval_fail_max=1min; r1 { test="true"; interval_fail=5s } }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	rule := c.Rules["g1/r1"]
+	if rule.IntervalFailMax != time.Minute || rule.IntervalFailMultiplier != 2 {
+		t.Errorf("Received unexpected rule: %+v", rule)
+	}
+
+	if e := c.SetConfiguration(`r1 { test="true"; interval_fail=5s; interval_fail_max=1s }`); e == nil {
+		t.Errorf("Expected error for interval_fail_max below interval_fail")
+	}
+
+	if e := c.SetConfiguration(`r1 { test="true"; interval_fail_multiplier=0.5 }`); e == nil {
+		t.Errorf("Expected error for interval_fail_multiplier below 1")
+	}
+}
+
+func TestConfigOutputLimit(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`r1 { test="true" } r2 { test="true"; fail_match="DEGRADED" } r3 { test="true"; fail_match="DEGRADED"; output_limit=0 }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	// only capped by default when matching on the output
+	for name, limit := range map[string]int{"r1": 0, "r2": defaultOutputLimit, "r3": 0} {
+		if got := c.Rules[name].OutputLimit; got != limit {
+			t.Errorf("Expected %s to keep %d bytes of output, got: %d", name, limit, got)
+		}
+	}
+}
+
+func TestConfigChangeTimeoutKill(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`g1 { change_timeout_kill=1min; r1 { test="true" } } r2 { test="true" } r3 { test="true"; change_timeout_kill=0 }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	// bounded by default, unless asked not to be
+	for name, timeout := range map[string]time.Duration{"g1/r1": time.Minute, "r2": defaultChangeTimeoutKill, "r3": 0} {
+		if got := c.Rules[name].ChangeTimeoutKill; got != timeout {
+			t.Errorf("Expected %s to kill change commands after %v, got: %v", name, timeout, got)
+		}
+	}
+}
+
+func TestConfigMatchInherited(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`g1 { success_match="^OK"; fail_match="^DEGRADED"; r1 { test="true" } r2 { test="true"; fail_match="" } }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	r1 := c.Rules["g1/r1"]
+	if r1.SuccessMatch == nil || r1.SuccessMatch.String() != "^OK" || r1.FailMatch == nil || r1.FailMatch.String() != "^DEGRADED" {
+		t.Errorf("Expected the group's matches inherited, got: %v, %v", r1.SuccessMatch, r1.FailMatch)
+	}
+
+	r2 := c.Rules["g1/r2"]
+	if r2.SuccessMatch == nil || r2.FailMatch != nil {
+		t.Errorf("Expected an empty fail_match to override the group's, got: %v, %v", r2.SuccessMatch, r2.FailMatch)
+	}
+}
+
+func TestConfigExitCodes(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`r1 { test="true"; fail_exit_codes=[2, "4-6"] }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	if codes := c.Rules["r1"].FailExitCodes; !reflect.DeepEqual(codes, [][2]int{{2, 2}, {4, 6}}) {
+		t.Errorf("Received unexpected fail_exit_codes: %v", codes)
+	}
+
+	e := c.SetConfiguration(`r1 { test="true"; fail_exit_codes="6-4" }`)
+	if e == nil || !strings.Contains(e.Error(), "exit codes") {
+		t.Errorf("Expected error about exit codes, got: %v", e)
+	}
+}
@@ -0,0 +1,322 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+/* definitions */
+
+/* one request per connection, the arguments are those given to hfmctl */
+type ControlRequest struct {
+	Command string
+	Args    []string
+}
+
+type ControlResponse struct {
+	Error  string      `json:",omitempty"`
+	Result interface{} `json:",omitempty"`
+}
+
+type RuleSummary struct {
+	Name      string
+	GroupName string
+	Status    RuleStatusType
+	LastState RuleStateType
+	Running   bool
+	Paused    bool
+	Override  RuleStatusType
+
+	ChangePending bool
+	ChangeFailed  bool
+	Blocked       string
+	Maintenance   bool
+}
+
+type controlCall struct {
+	request ControlRequest
+	reply   chan ControlResponse
+}
+
+/* how long a control client has to send its request, and read the response,
+ * by default
+ */
+const defaultControlTimeout = 10 * time.Second
+
+/* meat */
+
+/* Listen for control requests on a unix domain socket at path.  Requests are
+ * answered from the control loop, so only while Run is running.
+ */
+func (cl *ControlLoop) ListenControl(path string) error {
+	/* a socket left behind by an unclean exit would have us fail, one still
+	 * listening belongs to another hfm
+	 */
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := dialStale(path); err != nil {
+			return err
+		}
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	cl.controlListener = l
+	go cl.acceptControl(l)
+
+	log.Info("Listening for control requests on %v.", path)
+
+	return nil
+}
+
+/* nil if nothing is listening on the socket at path, so it can be removed */
+func dialStale(path string) error {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%v is already in use", path)
+	}
+
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNREFUSED {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%v is already in use: %v", path, err)
+}
+
+func (cl *ControlLoop) closeControl() {
+	if cl.controlListener == nil {
+		return
+	}
+
+	cl.controlListener.Close()
+	close(cl.controlClosed)
+}
+
+func (cl *ControlLoop) acceptControl(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			/* closed on the way out */
+			return
+		}
+
+		go cl.serveControl(conn)
+	}
+}
+
+func (cl *ControlLoop) serveControl(conn net.Conn) {
+	defer conn.Close()
+
+	var response ControlResponse
+	call := controlCall{reply: make(chan ControlResponse, 1)}
+
+	/* a client that never sends would hold the connection forever */
+	conn.SetDeadline(time.Now().Add(cl.ControlTimeout))
+
+	if err := json.NewDecoder(conn).Decode(&call.request); err != nil {
+		response.Error = fmt.Sprintf("Could not decode request: %v", err)
+	} else {
+		select {
+		case cl.controlCalls <- call:
+			response = <-call.reply
+		case <-cl.controlClosed:
+			response.Error = "Shutting down."
+		}
+	}
+
+	/* the control loop may have been busy, the client gets as long again */
+	conn.SetDeadline(time.Now().Add(cl.ControlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(&response); err != nil {
+		log.Error("Could not send control response: %v", err)
+	}
+}
+
+/* rule names matching target, either the rule itself, or the rules in a
+ * group
+ */
+func (cl *ControlLoop) matchRules(target string) []string {
+	var names []string
+
+	for _, name := range cl.rulesOrder {
+		if rule, ok := cl.rules[name]; ok && (rule.Name == target || rule.GroupName == target) {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func (cl *ControlLoop) summarize(name string) RuleSummary {
+	driver := cl.drivers[name]
+	_, running := cl.active[driver]
+	s := driver.Snapshot()
+
+	return RuleSummary{
+		Name:      s.Rule.Name,
+		GroupName: s.Rule.GroupName,
+		Status:    s.Rule.Status,
+		LastState: s.Rule.LastState,
+		Running:   running,
+		Paused:    s.Paused,
+		Override:  s.Override,
+
+		ChangePending: s.ChangePending,
+		ChangeFailed:  s.ChangeFailed,
+		Blocked:       s.Blocked,
+		Maintenance:   !s.MaintenanceUntil.IsZero(),
+	}
+}
+
+/* answer a control request, runs in the control loop's goroutine */
+func (cl *ControlLoop) handleControl(request ControlRequest) (response ControlResponse) {
+	args := request.Args
+
+	/* commands that act on a rule or group take it as the first argument */
+	var names []string
+	switch request.Command {
+	case "list":
+		if len(args) != 0 {
+			response.Error = "usage: list"
+			return
+		}
+	case "show", "enable", "disable", "run", "override", "maintenance":
+		if len(args) < 1 {
+			response.Error = fmt.Sprintf("usage: %s <rule|group> ...", request.Command)
+			return
+		}
+
+		if names = cl.matchRules(args[0]); len(names) == 0 {
+			response.Error = fmt.Sprintf("%s: no such rule or group", args[0])
+			return
+		}
+	default:
+		response.Error = fmt.Sprintf("%s: unrecognized command, expected one of {list, show, enable, disable, run, override, maintenance}", request.Command)
+		return
+	}
+
+	switch request.Command {
+	case "list":
+		summaries := []RuleSummary{}
+		for _, name := range cl.rulesOrder {
+			summaries = append(summaries, cl.summarize(name))
+		}
+		response.Result = summaries
+	case "show":
+		snapshots := []RuleSnapshot{}
+		for _, name := range names {
+			snapshots = append(snapshots, cl.drivers[name].Snapshot())
+		}
+		response.Result = snapshots
+	case "enable", "disable":
+		for _, name := range names {
+			log.Info("'%s' %sd from the control socket", name, request.Command)
+			cl.drivers[name].SetPaused(request.Command == "disable")
+		}
+		response.Result = names
+	case "run":
+		for _, name := range names {
+			cl.drivers[name].RunNow()
+		}
+		response.Result = names
+	case "override":
+		var status RuleStatusType
+		var until time.Time
+
+		if len(args) < 2 || len(args) > 3 {
+			response.Error = "usage: override <rule|group> <enabled|always-fail|always-success|clear> [duration]"
+			return
+		}
+
+		if args[1] != "clear" {
+			var ok bool
+			if status, ok = ParseRuleStatus(args[1]); !ok || status == RuleStatusDisabled {
+				response.Error = fmt.Sprintf("%s: status must be one of {enabled, always-fail, always-success, clear}", args[1])
+				return
+			}
+		}
+
+		if len(args) == 3 {
+			d, err := time.ParseDuration(args[2])
+			if err != nil || d <= 0 {
+				response.Error = fmt.Sprintf("%s: not a valid duration", args[2])
+				return
+			}
+			until = time.Now().Add(d)
+		}
+
+		for _, name := range names {
+			log.Info("'%s' status overridden from the control socket: %v", name, args[1:])
+			cl.drivers[name].SetOverride(status, until)
+		}
+		response.Result = names
+	case "maintenance":
+		var until time.Time
+
+		if len(args) != 2 {
+			response.Error = "usage: maintenance <rule|group> <duration|clear>"
+			return
+		}
+
+		if args[1] != "clear" {
+			d, err := time.ParseDuration(args[1])
+			if err != nil || d <= 0 {
+				response.Error = fmt.Sprintf("%s: not a valid duration", args[1])
+				return
+			}
+			until = time.Now().Add(d)
+		}
+
+		for _, name := range names {
+			log.Info("'%s' maintenance window set from the control socket: %v", name, args[1])
+			cl.drivers[name].SetMaintenance(until)
+		}
+		response.Result = names
+	}
+
+	return
+}
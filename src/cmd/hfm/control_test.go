@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "encoding/json"
+import "io/ioutil"
+import "net"
+import "os"
+import "syscall"
+import "testing"
+import "time"
+
+func TestControlHandleCommands(t *testing.T) {
+	var c Configuration
+
+	c.SetConfiguration(`
+interval=1h
+g1 { r1 { test="true" } r2 { test="true" } }
+r3 { test="true" }
+`)
+
+	cl := NewControlLoop("", 0)
+	cl.ApplyConfiguration(&c)
+
+	r := cl.handleControl(ControlRequest{Command: "list"})
+	if r.Error != "" || len(r.Result.([]RuleSummary)) != 3 {
+		t.Errorf("Unexpected list response: %+v", r)
+	}
+
+	r = cl.handleControl(ControlRequest{Command: "disable", Args: []string{"g1"}})
+	if r.Error != "" || len(r.Result.([]string)) != 2 {
+		t.Errorf("Unexpected disable response: %+v", r)
+	}
+
+	if !cl.drivers["g1/r1"].Snapshot().Paused || !cl.drivers["g1/r2"].Snapshot().Paused {
+		t.Errorf("Group rules were not paused")
+	}
+
+	if cl.drivers["r3"].Snapshot().Paused {
+		t.Errorf("Rule outside of group was paused")
+	}
+
+	r = cl.handleControl(ControlRequest{Command: "override", Args: []string{"r3", "always-fail", "1h"}})
+	if r.Error != "" {
+		t.Errorf("Unexpected override response: %+v", r)
+	}
+
+	if s := cl.drivers["r3"].Snapshot(); s.Override != RuleStatusAlwaysFail || s.OverrideUntil.IsZero() {
+		t.Errorf("Override was not applied: %+v", s)
+	}
+
+	r = cl.handleControl(ControlRequest{Command: "override", Args: []string{"r3", "disabled"}})
+	if r.Error == "" {
+		t.Errorf("Expected an error overriding to disabled")
+	}
+
+	r = cl.handleControl(ControlRequest{Command: "show", Args: []string{"nonexistent"}})
+	if r.Error == "" {
+		t.Errorf("Expected an error showing a missing rule")
+	}
+
+	r = cl.handleControl(ControlRequest{Command: "bogus"})
+	if r.Error == "" {
+		t.Errorf("Expected an error for an unrecognized command")
+	}
+
+	cl.ApplyConfiguration(&Configuration{})
+	cl.Run()
+}
+
+func TestControlOverrideExpires(t *testing.T) {
+	var c Configuration
+
+	c.SetConfiguration(`status=always-success; test="true"`)
+
+	driver := NewRuleDriver(*c.Rules["default"], nil, 0)
+
+	driver.SetOverride(RuleStatusAlwaysFail, time.Now().Add(time.Hour))
+	if s := driver.effectiveStatus(); s != RuleStatusAlwaysFail {
+		t.Errorf("Expected overridden status, got: %v", s)
+	}
+
+	driver.SetOverride(RuleStatusAlwaysFail, time.Now().Add(-time.Second))
+	if s := driver.effectiveStatus(); s != RuleStatusAlwaysSuccess {
+		t.Errorf("Expected configured status after expiry, got: %v", s)
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	var c Configuration
+
+	dir, err := ioutil.TempDir("", "hfm-test-suite-control-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c.SetConfiguration(`interval=1h; r1 { test="true" }`)
+
+	cl := NewControlLoop("", 0)
+	cl.ControlTimeout = 100 * time.Millisecond
+	if err := cl.ListenControl(dir + "/hfm.sock"); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	cl.ApplyConfiguration(&c)
+
+	done := make(chan struct{})
+	go func() {
+		cl.Run()
+		close(done)
+	}()
+
+	conn, err := net.Dial("unix", dir+"/hfm.sock")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	json.NewEncoder(conn).Encode(ControlRequest{Command: "show", Args: []string{"r1"}})
+
+	var response struct {
+		Error  string
+		Result []struct{ Rule struct{ Name string } }
+	}
+
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		t.Errorf("Could not decode response: %v", err)
+	} else if response.Error != "" || len(response.Result) != 1 || response.Result[0].Rule.Name != "r1" {
+		t.Errorf("Unexpected show response: %+v", response)
+	}
+
+	// a client that never sends is hung up on
+	idle, err := net.Dial("unix", dir+"/hfm.sock")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer idle.Close()
+
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(idle); err != nil {
+		t.Errorf("Expected an idle client to be hung up on, got: %v", err)
+	}
+
+	// a second hfm doesn't take over the socket
+	if err := NewControlLoop("", 0).ListenControl(dir + "/hfm.sock"); err == nil {
+		t.Errorf("Expected error listening on a socket in use")
+	}
+
+	cl.signals <- syscall.SIGTERM
+	<-done
+}
+
+func TestControlSocketStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-control-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// left behind, with nothing listening
+	l, err := net.Listen("unix", dir+"/hfm.sock")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	cl := NewControlLoop("", 0)
+	if err := cl.ListenControl(dir + "/hfm.sock"); err != nil {
+		t.Errorf("Expected a stale socket to be replaced, got: %v", err)
+	}
+	cl.closeControl()
+}
@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+/* definitions */
+
+/* owns the set of rule drivers for the lifetime of the process, and keeps
+ * them in line with the configuration
+ */
+type ControlLoop struct {
+	/* path to the configuration file, re-read on reload */
+	ConfigPath string
+
+	/* used by every driver to build unique run ids */
+	AppInstance uint64
+
+	/* the rule definitions that were last applied, string maps to rule
+	 * name
+	 */
+	rules map[string]Rule
+
+	/* the most recent driver dispatched for each rule, string maps to rule
+	 * name
+	 */
+	drivers map[string]*RuleDriver
+
+	/* the order rules were applied in, so we can dispatch in parse order */
+	rulesOrder []string
+
+	/* dispatched drivers that haven't sent on ruleDone yet, including
+	 * ones that have been asked to stop
+	 */
+	active map[*RuleDriver]struct{}
+
+	/* on shutdown, how long running test and change processes are given to
+	 * complete before being sent SIGINT, and SIGKILL.  A value of 0 means
+	 * the signal will not be sent.
+	 */
+	ShutdownInt  time.Duration
+	ShutdownKill time.Duration
+
+	shuttingDown bool
+	shutdownInt  <-chan time.Time
+	shutdownKill <-chan time.Time
+
+	/* counters for every rule, kept across reloads */
+	Metrics *Metrics
+
+	/* where rule state is kept across restarts, may be nil */
+	State *StateFile
+
+	/* the state of every rule, for the rules that depend on them */
+	Dependencies *Dependencies
+
+	/* how many test processes may run at once */
+	Limits *TestLimits
+
+	/* how long a control client has to send its request, and read the
+	 * response
+	 */
+	ControlTimeout time.Duration
+
+	/* requests from the control socket, answered in the loop */
+	controlListener net.Listener
+	controlCalls    chan controlCall
+	controlClosed   chan struct{}
+
+	ruleDone chan *RuleDriver
+	signals  chan os.Signal
+}
+
+/* meat */
+
+func NewControlLoop(configPath string, appInstance uint64) *ControlLoop {
+	var cl ControlLoop
+
+	cl.ConfigPath = configPath
+	cl.AppInstance = appInstance
+
+	cl.rules = make(map[string]Rule)
+	cl.drivers = make(map[string]*RuleDriver)
+	cl.active = make(map[*RuleDriver]struct{})
+	cl.Metrics = NewMetrics()
+	cl.Dependencies = NewDependencies()
+	cl.Limits = NewTestLimits()
+
+	cl.ControlTimeout = defaultControlTimeout
+	cl.controlCalls = make(chan controlCall)
+	cl.controlClosed = make(chan struct{})
+
+	cl.ruleDone = make(chan *RuleDriver)
+	cl.signals = make(chan os.Signal, 1)
+
+	return &cl
+}
+
+/* start a driver for rule, picking up from carried, if given, otherwise from
+ * the state file
+ */
+func (cl *ControlLoop) startDriver(rule Rule, carried *PersistedRule) {
+	log.Debug("Dispatching rule '%s'", rule.Name)
+	log.Debug("%s details: %+v", rule.Name, rule)
+
+	// driver gets its own copy of the rule, safe from
+	// side effects later
+	driver := NewRuleDriver(rule, cl.ruleDone, cl.AppInstance)
+	driver.metrics = cl.Metrics.rule(rule.Name, rule.GroupName)
+	driver.deps = cl.Dependencies
+	driver.limits = cl.Limits
+	if carried != nil {
+		driver.state = cl.State
+		driver.restore(*carried)
+	} else if cl.State != nil {
+		driver.restoreState(cl.State)
+	}
+
+	cl.rules[rule.Name] = rule
+	cl.drivers[rule.Name] = driver
+	cl.active[driver] = struct{}{}
+
+	go driver.Run()
+}
+
+/* Stop the rule's driver.  It may still be finishing a run, so it's
+ * detached first, leaving the rule's state to its successor, if any.
+ * Returns the state it last persisted, nil if none.
+ */
+func (cl *ControlLoop) stopDriver(name string) *PersistedRule {
+	var carried *PersistedRule
+
+	if driver, ok := cl.drivers[name]; ok {
+		if pr, ok := driver.detach(); ok {
+			carried = &pr
+		}
+		driver.Stop()
+	}
+
+	delete(cl.drivers, name)
+	delete(cl.rules, name)
+
+	return carried
+}
+
+/* drop a rule from the state file, and dependencies, so it starts afresh if
+ * it comes back
+ */
+func (cl *ControlLoop) forgetState(name string) {
+	cl.Dependencies.remove(name)
+
+	if e := cl.State.remove(name); e != nil {
+		log.Error("Could not write state file %v: %v", cl.State.Path, e)
+	}
+}
+
+/* reconcile the dispatched drivers against config: new rules are started,
+ * removed rules are stopped, changed rules are restarted with the state they
+ * had, and unchanged rules are left alone
+ */
+func (cl *ControlLoop) ApplyConfiguration(config *Configuration) {
+	var started, stopped, restarted int
+
+	if cl.shuttingDown {
+		log.Info("Shutting down, not applying configuration.")
+		return
+	}
+
+	groups := make(map[string]int)
+	for _, rule := range config.Rules {
+		groups[rule.GroupName] = int(rule.GroupMaxConcurrentTests)
+	}
+	cl.Limits.configure(config.MaxConcurrentTests, groups)
+
+	for _, name := range cl.rulesOrder {
+		if _, ok := config.Rules[name]; !ok {
+			log.Info("'%s' removed from configuration, stopping", name)
+			cl.stopDriver(name)
+			cl.Metrics.remove(name)
+			cl.forgetState(name)
+			stopped++
+		}
+	}
+
+	for _, name := range config.RulesOrder {
+		rule := *config.Rules[name]
+
+		old, ok := cl.rules[name]
+		switch {
+		case !ok:
+			cl.startDriver(rule, nil)
+			started++
+		case !reflect.DeepEqual(old, rule):
+			log.Info("'%s' changed in configuration, restarting", name)
+			cl.startDriver(rule, cl.stopDriver(name))
+			restarted++
+		}
+	}
+
+	cl.rulesOrder = append([]string(nil), config.RulesOrder...)
+
+	log.Info("Applied configuration: %d started, %d stopped, %d restarted, %d unchanged.", started, stopped, restarted, len(cl.rulesOrder)-started-restarted)
+}
+
+/* re-read the configuration from disk, and apply it.  If the configuration
+ * can't be loaded, the running configuration is left as it is.
+ */
+func (cl *ControlLoop) Reload() error {
+	var config Configuration
+
+	if e := config.LoadConfiguration(cl.ConfigPath); e != nil {
+		log.Error("Could not reload configuration file %v, keeping running configuration: %v", cl.ConfigPath, e)
+		return e
+	}
+
+	log.Info("Reloaded %d rules from %v.", len(config.Rules), cl.ConfigPath)
+	cl.ApplyConfiguration(&config)
+
+	return nil
+}
+
+/* stop scheduling runs for every rule, and arrange for any processes still
+ * running to be signalled once the shutdown timeouts pass
+ */
+func (cl *ControlLoop) Shutdown() {
+	if cl.shuttingDown {
+		log.Info("Already shutting down, %d rules remaining.", len(cl.active))
+		return
+	}
+	cl.shuttingDown = true
+
+	log.Info("Shutting down, waiting on %d rules.", len(cl.active))
+
+	for driver := range cl.active {
+		driver.Stop()
+	}
+
+	if cl.ShutdownInt > 0 {
+		cl.shutdownInt = time.After(cl.ShutdownInt)
+	}
+
+	if cl.ShutdownKill > 0 {
+		cl.shutdownKill = time.After(cl.ShutdownKill)
+	}
+}
+
+func (cl *ControlLoop) signalChildren(sig os.Signal) {
+	count := 0
+	for driver := range cl.active {
+		count += driver.SignalChildren(sig)
+	}
+
+	log.Warning("Shutdown timeout exceeded, sent %v to %d processes.", sig, count)
+}
+
+func (cl *ControlLoop) handleDone(driver *RuleDriver) {
+	delete(cl.active, driver)
+	log.Info("'%s' completed execution.  Ran for: %v\n\n", driver.Rule.Name, driver.Last.ExecDuration)
+}
+
+func (cl *ControlLoop) handleSignal(sig os.Signal) {
+	switch sig {
+	case syscall.SIGHUP:
+		log.Info("Received %v, reloading configuration.", sig)
+		cl.Reload()
+	case syscall.SIGINT, syscall.SIGTERM:
+		log.Info("Received %v, shutting down.", sig)
+		cl.Shutdown()
+	}
+}
+
+/* process events until every dispatched driver has completed */
+func (cl *ControlLoop) Run() {
+	signal.Notify(cl.signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(cl.signals)
+	defer cl.closeControl()
+
+	for len(cl.active) > 0 {
+		select {
+		case driver := <-cl.ruleDone:
+			cl.handleDone(driver)
+		case sig := <-cl.signals:
+			cl.handleSignal(sig)
+		case call := <-cl.controlCalls:
+			call.reply <- cl.handleControl(call.request)
+		case <-cl.shutdownInt:
+			cl.shutdownInt = nil
+			cl.signalChildren(syscall.SIGINT)
+		case <-cl.shutdownKill:
+			cl.shutdownKill = nil
+			cl.signalChildren(syscall.SIGKILL)
+		}
+	}
+
+	/* run counts are only written along with state changes */
+	if e := cl.State.flush(); e != nil {
+		log.Error("Could not write state file %v: %v", cl.State.Path, e)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "testing"
+import "time"
+import "os"
+import "io/ioutil"
+
+func TestControlLoopApplyConfiguration(t *testing.T) {
+	var c1, c2 Configuration
+
+	c1.SetConfiguration(`
+interval=10ms
+unchanged { test="true" }
+changed { test="true" }
+removed { test="true" }
+`)
+
+	c2.SetConfiguration(`
+interval=10ms
+unchanged { test="true" }
+changed { test="false" }
+added { test="true" }
+`)
+
+	cl := NewControlLoop("", 0)
+
+	cl.ApplyConfiguration(&c1)
+	if len(cl.active) != 3 {
+		t.Errorf("Expected 3 running drivers, got: %d", len(cl.active))
+	}
+
+	unchanged := cl.drivers["unchanged"]
+	changed := cl.drivers["changed"]
+
+	cl.ApplyConfiguration(&c2)
+
+	if cl.drivers["unchanged"] != unchanged {
+		t.Errorf("Unchanged rule was restarted")
+	}
+
+	if cl.drivers["changed"] == changed {
+		t.Errorf("Changed rule was not restarted")
+	}
+
+	if _, ok := cl.drivers["removed"]; ok {
+		t.Errorf("Removed rule is still dispatched")
+	}
+
+	if _, ok := cl.drivers["added"]; !ok {
+		t.Errorf("Added rule was not dispatched")
+	}
+
+	// changed and removed are on their way out, added is new
+	if len(cl.active) != 5 {
+		t.Errorf("Expected 5 running drivers, got: %d", len(cl.active))
+	}
+
+	// an empty configuration stops everything, so Run will return
+	cl.ApplyConfiguration(&Configuration{})
+	cl.Run()
+
+	if len(cl.drivers) != 0 {
+		t.Errorf("Expected no dispatched drivers, got: %d", len(cl.drivers))
+	}
+}
+
+func TestControlLoopReloadError(t *testing.T) {
+	var c Configuration
+
+	c.SetConfiguration(`interval=10ms; r1 { test="true" }`)
+
+	cl := NewControlLoop("/nonexistent/hfm.conf", 0)
+	cl.ApplyConfiguration(&c)
+
+	r1 := cl.drivers["r1"]
+
+	if e := cl.Reload(); e == nil {
+		t.Errorf("Expected an error reloading a missing configuration file")
+	}
+
+	if cl.drivers["r1"] != r1 {
+		t.Errorf("Failed reload disturbed the running configuration")
+	}
+
+	cl.ApplyConfiguration(&Configuration{})
+	cl.Run()
+}
+
+func TestControlLoopShutdownInterrupt(t *testing.T) {
+	var c Configuration
+
+	dir, err := ioutil.TempDir("", "hfm-test-suite-shutdown-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	marker := dir + "/changed"
+
+	c.SetConfiguration(`r1 { test="sleep"; test_arguments="10"; change_fail="touch"; change_fail_arguments="` + marker + `" }`)
+
+	cl := NewControlLoop("", 0)
+	cl.ShutdownInt = 50 * time.Millisecond
+	cl.ApplyConfiguration(&c)
+
+	// let the test get started
+	time.Sleep(50 * time.Millisecond)
+
+	s := time.Now()
+	cl.Shutdown()
+	cl.Run()
+
+	if e := time.Since(s); e > 5*time.Second {
+		t.Errorf("took %v to shut down", e)
+	}
+
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("Interrupted test caused a state change")
+	}
+}
+
+func TestControlLoopRestartKeepsState(t *testing.T) {
+	var c1, c2 Configuration
+
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c1.SetConfiguration(`r1 { test="false"; interval=10ms }`)
+	c2.SetConfiguration(`r1 { test="false"; interval=20ms }`)
+
+	cl := NewControlLoop("", 0)
+	cl.State, _ = LoadStateFile(dir + "/state")
+
+	cl.ApplyConfiguration(&c1)
+	changed := cl.drivers["r1"]
+
+	for changed.Snapshot().Rule.LastState != RuleStateFail {
+		time.Sleep(time.Millisecond)
+	}
+
+	cl.ApplyConfiguration(&c2)
+
+	if snap := cl.drivers["r1"].Snapshot(); snap.Rule.LastState != RuleStateFail {
+		t.Errorf("Expected the restarted rule to keep its state, got: %v", snap.Rule.LastState)
+	}
+
+	if pr, ok := cl.State.get("r1"); !ok || pr.State != "fail" {
+		t.Errorf("Expected the restarted rule to stay in the state file, got: %+v", pr)
+	}
+
+	cl.ApplyConfiguration(&Configuration{})
+	cl.Run()
+
+	if _, ok := cl.State.get("r1"); ok {
+		t.Errorf("Expected the removed rule to be dropped from the state file")
+	}
+}
+
+func TestControlLoopFlushesState(t *testing.T) {
+	var c Configuration
+
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c.SetConfiguration(`r1 { test="true"; interval=10ms; runs=3 }`)
+
+	cl := NewControlLoop("", 0)
+	cl.State, _ = LoadStateFile(dir + "/state")
+
+	cl.ApplyConfiguration(&c)
+	cl.Run()
+
+	// only the first run changed the state, the count is written on the
+	// way out
+	sf, _ := LoadStateFile(dir + "/state")
+	if pr, ok := sf.get("r1"); !ok || pr.State != "success" || pr.Count != 3 {
+		t.Errorf("Expected r1 persisted as success after 3 runs, got: %+v", pr)
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* definitions */
+
+/* A test process started once, and kept running between runs.  For each run,
+ * the run's uid is written to its stdin as a line, and it answers with a line
+ * on stdout:
+ *
+ *   <status>[\t<message>[\t<name>=<value> ...]]
+ *
+ * where status is an exit status, 0 being success, and the optional metrics
+ * are numbers recorded with the run.
+ */
+type coprocess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	/* a line per response, closed once the process has exited */
+	lines chan string
+
+	/* how the process exited, valid once lines is closed */
+	err error
+
+	/* written to by the process at any time, collected with each run */
+	stderr lockedBuffer
+}
+
+/* a buffer safe to write to from the process, and read from the driver */
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+/* how long a coprocess has to exit after its stdin is closed, before it is
+ * killed
+ */
+const coprocessStopGrace = time.Second
+
+/* names of metrics reported by a coprocess */
+var coprocessMetricName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+/* meat */
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.buf.Write(p)
+}
+
+/* move everything written so far to dst */
+func (b *lockedBuffer) drainTo(dst io.Writer) {
+	b.Lock()
+	defer b.Unlock()
+
+	dst.Write(b.buf.Bytes())
+	b.buf.Reset()
+}
+
+func (rd *RuleDriver) startCoprocess() (*coprocess, error) {
+	cp := &coprocess{lines: make(chan string)}
+
+	/* the run uid, etc. are as of the run that started it */
+	cp.cmd = exec.Command(rd.Rule.Test, rd.Rule.TestArguments...)
+	cp.cmd.Env = rd.commandEnv("HFM_PREVIOUS_STATE=" + rd.Rule.LastState.Name())
+	cp.cmd.Stderr = &cp.stderr
+
+	stdin, err := cp.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	cp.stdin = stdin
+
+	stdout, err := cp.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cp.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	rd.children.add(cp.cmd.Process)
+
+	go func() {
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			cp.lines <- s.Text()
+		}
+
+		/* a line we can't read, we won't be able to read the rest */
+		if s.Err() != nil {
+			cp.cmd.Process.Kill()
+		}
+
+		cp.err = cp.cmd.Wait()
+		rd.children.remove(cp.cmd.Process)
+		close(cp.lines)
+	}()
+
+	log.Info("'%s' run %s started coprocess %d", rd.Rule.Name, rd.GetRunUid(), cp.cmd.Process.Pid)
+
+	return cp, nil
+}
+
+/* ask the coprocess to exit by closing its stdin, killing it if it doesn't */
+func (cp *coprocess) stop() {
+	cp.stdin.Close()
+
+	timer := time.NewTimer(coprocessStopGrace)
+	defer timer.Stop()
+
+	for {
+		select {
+		case _, ok := <-cp.lines:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+			cp.cmd.Process.Kill()
+		}
+	}
+}
+
+/* stop the coprocess, if there is one */
+func (rd *RuleDriver) stopCoprocess() {
+	if rd.coproc == nil {
+		return
+	}
+
+	rd.coproc.stop()
+	rd.coproc = nil
+}
+
+/* ask the coprocess for the result of this run, starting it if it isn't
+ * running, false if it couldn't be started, or was killed by the driver being
+ * asked to stop
+ */
+func (rd *RuleDriver) runCoprocess() bool {
+	if rd.coproc == nil {
+		cp, err := rd.startCoprocess()
+		if err != nil {
+			rd.Rule.Status = RuleStatusDisabled
+			log.Error("'%s' %s coprocess failed to start, disabling: %v", rd.Rule.Name, rd.GetRunUid(), err)
+
+			return false
+		}
+		rd.coproc = cp
+	}
+
+	cp := rd.coproc
+	defer cp.stderr.drainTo(&rd.err)
+
+	/* if it has died, we'll find out reading the response */
+	io.WriteString(cp.stdin, rd.GetRunUid()+"\n")
+
+	var timeoutInt, timeoutKill <-chan time.Time
+	if rd.Rule.TimeoutInt > 0 {
+		t := time.NewTimer(rd.Rule.TimeoutInt)
+		defer t.Stop()
+		timeoutInt = t.C
+	}
+	if rd.Rule.TimeoutKill > 0 {
+		t := time.NewTimer(rd.Rule.TimeoutKill)
+		defer t.Stop()
+		timeoutKill = t.C
+	}
+
+	for {
+		select {
+		case line, ok := <-cp.lines:
+			if !ok {
+				rd.handleCoprocessExit(cp.err)
+				return true
+			}
+
+			rd.handleCoprocessResult(line)
+			return true
+		case <-timeoutInt:
+			timeoutInt = nil
+			rd.handleCmdIntTimeout(cp.cmd)
+		case <-timeoutKill:
+			timeoutKill = nil
+			rd.handleCmdKillTimeout(cp.cmd)
+		case <-rd.quit:
+			/* it may never answer, and won't be asked again */
+			log.Info("'%s' run %v stopped by shutdown, killing coprocess %d", rd.Rule.Name, rd.GetRunUid(), cp.cmd.Process.Pid)
+
+			cp.cmd.Process.Kill()
+			rd.coproc = nil
+
+			/* reaped once its output is closed */
+			go func() {
+				for range cp.lines {
+				}
+			}()
+
+			return false
+		}
+	}
+}
+
+/* the coprocess died before answering, it'll be restarted next run */
+func (rd *RuleDriver) handleCoprocessExit(err error) {
+	rd.coproc = nil
+
+	if err == nil {
+		err = errors.New("exited")
+	}
+	rd.Last.Error = fmt.Errorf("coprocess: %v", err)
+	rd.Last.ExitStatus = 1
+
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.ExitStatus() > 0 {
+			rd.Last.ExitStatus = ws.ExitStatus()
+		}
+	}
+
+	log.Error("'%s' run %s completed with error: %v", rd.Rule.Name, rd.GetRunUid(), rd.Last.Error)
+}
+
+/* record the response of the coprocess as the result of the run */
+func (rd *RuleDriver) handleCoprocessResult(line string) {
+	fields := strings.SplitN(line, "\t", 3)
+
+	status, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		rd.Last.Error = fmt.Errorf("coprocess: malformed response: %q", line)
+		rd.Last.ExitStatus = 1
+
+		log.Error("'%s' run %s completed with error: %v", rd.Rule.Name, rd.GetRunUid(), rd.Last.Error)
+		return
+	}
+	rd.Last.ExitStatus = status
+
+	if len(fields) > 1 {
+		rd.Last.Message = fields[1]
+	}
+
+	if len(fields) > 2 {
+		for _, m := range strings.Fields(fields[2]) {
+			kv := strings.SplitN(m, "=", 2)
+			if len(kv) != 2 || !coprocessMetricName.MatchString(kv[0]) {
+				log.Warning("'%s' run %s ignoring malformed metric: %q", rd.Rule.Name, rd.GetRunUid(), m)
+				continue
+			}
+
+			v, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				log.Warning("'%s' run %s ignoring malformed metric: %q", rd.Rule.Name, rd.GetRunUid(), m)
+				continue
+			}
+
+			if rd.Last.Metrics == nil {
+				rd.Last.Metrics = make(map[string]float64)
+			}
+			rd.Last.Metrics[kv[0]] = v
+		}
+	}
+
+	if status != 0 {
+		msg := rd.Last.Message
+		if msg == "" {
+			msg = "exit status " + strconv.Itoa(status)
+		}
+		rd.Last.Error = errors.New(msg)
+
+		log.Error("'%s' run %s completed with error: %v", rd.Rule.Name, rd.GetRunUid(), rd.Last.Error)
+	} else if rd.Last.Message != "" {
+		log.Info("'%s' run %s test produced output: %v", rd.Rule.Name, rd.GetRunUid(), rd.Last.Message)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "bytes"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+/* run a coprocess rule to completion, with metrics */
+func runCoprocessRule(t *testing.T, cfg string) (*RuleDriver, string) {
+	var c Configuration
+	var buf bytes.Buffer
+
+	if e := c.SetConfiguration(`r1 { test_mode="coprocess"; test="/bin/sh"; ` + cfg + ` }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	m := NewMetrics()
+	ruleDone := make(chan *RuleDriver)
+
+	driver := NewRuleDriver(*c.Rules["r1"], ruleDone, 0)
+	driver.metrics = m.rule("r1", "default")
+	go driver.Run()
+	<-ruleDone
+
+	m.Expose(&buf)
+
+	return driver, buf.String()
+}
+
+func TestCoprocessResults(t *testing.T) {
+	// fails the first request, then reports metrics; one process throughout
+	script := `n=0; while read uid; do n=$((n+1)); if [ $n -eq 1 ]; then printf '1\tbroken\n'; else printf '0\tfine\tqueue_depth=3 latency_ms=1.5 bad=x\n'; fi; done`
+
+	driver, out := runCoprocessRule(t, `runs=3; interval=10ms; test_arguments=["-c", "`+script+`"]`)
+
+	if driver.Last.ExitStatus != 0 || driver.Last.Message != "fine" || driver.Rule.LastState != RuleStateSuccess {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+
+	if len(driver.Last.Metrics) != 2 || driver.Last.Metrics["queue_depth"] != 3 || driver.Last.Metrics["latency_ms"] != 1.5 {
+		t.Errorf("Received unexpected metrics: %v\n", driver.Last.Metrics)
+	}
+
+	for _, e := range []string{
+		`hfm_rule_runs_total{rule="r1",group="default"} 3`,
+		`hfm_rule_failures_total{rule="r1",group="default"} 1`,
+		`hfm_rule_test_metric{rule="r1",group="default",name="queue_depth"} 3`,
+	} {
+		if !strings.Contains(out, e+"\n") {
+			t.Errorf("Expected metrics to contain '%s', got:\n%s", e, out)
+		}
+	}
+
+	if driver.coproc != nil {
+		t.Errorf("Expected coprocess to be stopped")
+	}
+}
+
+func TestCoprocessRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-coprocess")
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// dies on the first request, answers once restarted
+	marker := filepath.Join(dir, "started")
+	script := `if [ -e ` + marker + ` ]; then while read uid; do echo 0; done; else touch ` + marker + `; read uid; exit 3; fi`
+
+	driver, out := runCoprocessRule(t, `runs=2; interval=10ms; test_arguments=["-c", "`+script+`"]`)
+
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success once restarted, received: %+v\n", driver.Last)
+	}
+
+	if !strings.Contains(out, `hfm_rule_failures_total{rule="r1",group="default"} 1`+"\n") {
+		t.Errorf("Expected the first run to fail, got:\n%s", out)
+	}
+}
+
+func TestCoprocessExitStatus(t *testing.T) {
+	driver, _ := runCoprocessRule(t, `runs=1; test_arguments=["-c", "read uid; exit 3"]`)
+
+	if driver.Last.ExitStatus != 3 || driver.Last.Error == nil {
+		t.Errorf("Expected the exit status of the coprocess, received: %+v\n", driver.Last)
+	}
+}
+
+func TestCoprocessKill(t *testing.T) {
+	// never answers
+	driver, _ := runCoprocessRule(t, `runs=1; timeout_kill=50ms; test_arguments=["-c", "while read uid; do read never; done"]`)
+
+	if driver.Last.ExitStatus == 0 || !driver.Last.Killed {
+		t.Errorf("Expected failure by timeout, received: %+v\n", driver.Last)
+	}
+}
+
+func TestCoprocessStopWhileWaiting(t *testing.T) {
+	var c Configuration
+
+	// answers nothing, and ignores its stdin closing
+	if e := c.SetConfiguration(`r1 { runs=1; test_mode="coprocess"; test="/bin/sh"; test_arguments=["-c", "read uid; exec sleep 100"] }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	ruleDone := make(chan *RuleDriver)
+
+	driver := NewRuleDriver(*c.Rules["r1"], ruleDone, 0)
+	go driver.Run()
+
+	time.Sleep(100 * time.Millisecond)
+	driver.Stop()
+
+	select {
+	case <-ruleDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Driver didn't stop while waiting on the coprocess")
+	}
+
+	if driver.Rule.LastState != RuleStateUnknown || driver.coproc != nil {
+		t.Errorf("Expected the stopped run not to count, and the coprocess gone, received: %v, %+v\n", driver.Rule.LastState, driver.Last)
+	}
+}
+
+func TestCoprocessConfig(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`r1 { test_mode="coprocess"; test_type="tcp"; address="127.0.0.1:22" }`); e == nil {
+		t.Errorf("Expected error for a native coprocess")
+	}
+
+	if e := c.SetConfiguration(`r1 { test_mode="bogus"; test="true" }`); e == nil {
+		t.Errorf("Expected error for an unrecognized test mode")
+	}
+}
@@ -35,9 +35,20 @@ import (
 )
 
 type DelayedTicker struct {
-	// emit a time when the next tick occurs
+	// emit a time when the next tick occurs, the time is when the tick was
+	// scheduled for, which may be well before it is received
 	C chan time.Time
 
+	// when set, each tick is held back by as long as it returns, given the
+	// interval, without moving the schedule.  Only called from the loop,
+	// set it before Start.
+	Jitter func(interval time.Duration) time.Duration
+
+	// when set, ticks follow the schedule rather than the interval, and
+	// time comes from Clock, the real one if nil.  Set them before Start.
+	Schedule *Schedule
+	Clock    Clock
+
 	// signal the loop to quit
 	quit chan struct{}
 
@@ -73,7 +84,11 @@ func (t *DelayedTicker) Start(delay time.Duration, interval time.Duration) error
 	t.lastTick = time.Now()
 
 	t.interval = interval
-	go t.loop(delay)
+	if t.Schedule != nil {
+		go t.scheduleLoop(delay)
+	} else {
+		go t.loop(delay)
+	}
 	<-t.loopStatus
 
 	return nil
@@ -84,6 +99,9 @@ func (t *DelayedTicker) loop(delay time.Duration) {
 	start := time.NewTimer(delay)
 	defer start.Stop()
 
+	// ticks are scheduled every interval from here
+	startAt := time.Now().Add(delay)
+
 	t.running = true
 	t.loopStatus <- struct{}{}
 
@@ -108,18 +126,103 @@ timerEvents:
 			} else {
 				immediate <- struct{}{}
 			}
-		case <-ticker.C:
+			t.lastTick = startAt
+		case now := <-ticker.C:
+			// the ticker drops ticks for slow receivers, find the
+			// one this is
+			n := (now.Sub(startAt) + t.interval/2) / t.interval
+			t.lastTick = startAt.Add(n * t.interval)
 		case <-immediate:
 			immediate <- struct{}{}
+			// nothing scheduled, as soon as possible
+			t.lastTick = time.Now()
+		}
+
+		tick := t.lastTick
+		if t.Jitter != nil {
+			if offset := t.Jitter(t.interval); offset > 0 {
+				tick = tick.Add(offset)
+
+				hold := time.NewTimer(time.Until(tick))
+				select {
+				case <-t.quit:
+					hold.Stop()
+					break timerEvents
+				case <-hold.C:
+				}
+			}
 		}
 
-		t.lastTick = time.Now()
 		select {
 		case <-t.quit:
 			// we need to be able to quit if the last event won't
 			// be consumed
 			break timerEvents
-		case t.C <- t.lastTick:
+		case t.C <- tick:
+		}
+	}
+
+	t.loopStatus <- struct{}{}
+}
+
+/* Like loop, but ticking as the schedule says, no sooner than delay from now.
+ * Each tick is found from the later of the last, and now, so a timer firing
+ * early can't repeat one, and ticks missed by a slow receiver are dropped.
+ */
+func (t *DelayedTicker) scheduleLoop(delay time.Duration) {
+	clock := t.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	from := clock.Now().Add(delay)
+
+	t.running = true
+	t.loopStatus <- struct{}{}
+
+timerEvents:
+	for {
+		if now := clock.Now(); now.After(from) {
+			from = now
+		}
+
+		next := t.Schedule.Next(from)
+		if next.IsZero() {
+			// nothing left to run, wait to be stopped
+			<-t.quit
+			break timerEvents
+		}
+
+		c, stop := clock.NewTimer(next.Sub(clock.Now()))
+		select {
+		case <-t.quit:
+			stop()
+			break timerEvents
+		case <-c:
+		}
+
+		t.lastTick = next
+		from = next
+
+		tick := t.lastTick
+		if t.Jitter != nil {
+			if offset := t.Jitter(t.interval); offset > 0 {
+				tick = tick.Add(offset)
+
+				c, stop := clock.NewTimer(offset)
+				select {
+				case <-t.quit:
+					stop()
+					break timerEvents
+				case <-c:
+				}
+			}
+		}
+
+		select {
+		case <-t.quit:
+			break timerEvents
+		case t.C <- tick:
 		}
 	}
 
@@ -154,7 +257,7 @@ func (t *DelayedTicker) ChangeRunningInterval(interval time.Duration) error {
 		return fmt.Errorf("DelayedTicker not running")
 	}
 
-	if interval == t.interval {
+	if interval == t.interval || t.Schedule != nil {
 		// change is a no-op
 		return nil
 	}
@@ -168,3 +271,8 @@ func (t *DelayedTicker) ChangeRunningInterval(interval time.Duration) error {
 
 	return nil
 }
+
+/* The interval between ticks currently in effect */
+func (t *DelayedTicker) Interval() time.Duration {
+	return t.interval
+}
@@ -230,3 +230,60 @@ func TestDelayedTickerAFewChanges(t *testing.T) {
 		}
 	}
 }
+
+func TestDelayedTickerScheduledTimes(t *testing.T) {
+	var l [3]time.Time
+
+	tv := time.Millisecond * 20
+
+	dt := NewDelayedTicker()
+	dt.Start(0, tv)
+
+	// a slow receiver shouldn't shift the schedule
+	for i := 0; i < len(l); i++ {
+		l[i] = <-dt.C
+		time.Sleep(tv + tv/2)
+	}
+	dt.Stop()
+
+	for i := 1; i < len(l); i++ {
+		if d := l[i].Sub(l[0]); d%tv != 0 {
+			t.Errorf("Tick %d at %v from the first, not on the schedule of every %v", i, d, tv)
+		}
+
+		if !l[i].After(l[i-1]) {
+			t.Errorf("Tick %d not after the one before it", i)
+		}
+	}
+}
+
+func TestDelayedTickerJitter(t *testing.T) {
+	var l [4]time.Time
+
+	tv := time.Millisecond * 20
+	jitter := time.Millisecond * 5
+
+	dt := NewDelayedTicker()
+	dt.Jitter = func(interval time.Duration) time.Duration {
+		if interval != tv {
+			t.Errorf("Expected jitter for interval %v, got: %v", tv, interval)
+		}
+		return jitter
+	}
+	dt.Start(0, tv)
+
+	for i := 0; i < len(l); i++ {
+		l[i] = <-dt.C
+		if late := time.Since(l[i]); late < 0 {
+			t.Errorf("Tick %d received %v before its time", i, -late)
+		}
+	}
+	dt.Stop()
+
+	// held back, but still on the schedule
+	for i := 1; i < len(l); i++ {
+		if d := l[i].Sub(l[0]); d%tv != 0 {
+			t.Errorf("Tick %d at %v from the first, not on the schedule of every %v", i, d, tv)
+		}
+	}
+}
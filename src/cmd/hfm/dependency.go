@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"sync"
+	"time"
+)
+
+/* definitions */
+
+/* how a rule looks to the rules that depend on it */
+type dependencyState struct {
+	State RuleStateType
+
+	/* the failed dependency holding the rule back, if any */
+	Blocked string
+}
+
+/* The state of every rule, so rules can follow the rules they depend on.
+ * Each driver records its own, and waits on changed to hear of the others'.
+ */
+type Dependencies struct {
+	sync.Mutex
+
+	/* string maps to rule name */
+	rules map[string]dependencyState
+
+	/* closed, and replaced whenever a rule's state changes */
+	changed chan struct{}
+}
+
+/* meat */
+
+func NewDependencies() *Dependencies {
+	return &Dependencies{rules: make(map[string]dependencyState), changed: make(chan struct{})}
+}
+
+/* record how a rule looks to its dependents, safe to call on nil */
+func (d *Dependencies) set(name string, ds dependencyState) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.rules[name] == ds {
+		return
+	}
+
+	d.rules[name] = ds
+	d.notify()
+}
+
+/* forget a rule, its dependents treat it as unknown, safe to call on nil */
+func (d *Dependencies) remove(name string) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.rules[name]; !ok {
+		return
+	}
+
+	delete(d.rules, name)
+	d.notify()
+}
+
+/* wake everyone waiting, must hold the lock */
+func (d *Dependencies) notify() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+/* the state of a rule, unknown if it hasn't reported, safe to call on nil */
+func (d *Dependencies) state(name string) RuleStateType {
+	if d == nil {
+		return RuleStateUnknown
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	return d.rules[name].State
+}
+
+/* The first of names that is failed, or is itself held back by a failed
+ * dependency, or "" if none are.  Also, a channel closed the next time any
+ * rule changes, nil if there is nothing to wait for.
+ */
+func (d *Dependencies) blocking(names []string) (string, <-chan struct{}) {
+	if d == nil || len(names) == 0 {
+		return "", nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for _, name := range names {
+		ds := d.rules[name]
+		if ds.State == RuleStateFail || ds.Blocked != "" {
+			return name, d.changed
+		}
+	}
+
+	return "", d.changed
+}
+
+/* let the rules that depend on this one know how it is */
+func (rd *RuleDriver) shareState() {
+	rd.persistence.Lock()
+	defer rd.persistence.Unlock()
+
+	if rd.persistence.detached {
+		return
+	}
+
+	rd.deps.set(rd.Rule.Name, dependencyState{State: rd.Rule.LastState, Blocked: rd.blocked})
+}
+
+/* catch up with the rules depended on, noting when they fail, or recover */
+func (rd *RuleDriver) checkDependencies() {
+	blocked, changed := rd.deps.blocking(rd.Rule.DependsOn)
+	rd.depsChanged = changed
+
+	if blocked == rd.blocked {
+		return
+	}
+
+	previous := rd.blocked
+	rd.blocked = blocked
+
+	switch {
+	case blocked == "":
+		log.Info("'%s' dependency '%s' recovered", rd.Rule.Name, previous)
+		rd.recovering = true
+	case previous == "":
+		if rd.Rule.DependsMode == RuleDependsPause {
+			log.Warning("'%s' dependency '%s' is failed, pausing runs, and suppressing change commands", rd.Rule.Name, blocked)
+		} else {
+			log.Warning("'%s' dependency '%s' is failed, suppressing change commands", rd.Rule.Name, blocked)
+		}
+		rd.recovering = false
+	}
+
+	rd.shareState()
+	rd.publish()
+}
+
+/* the rules depended on have recovered, bring the change commands up to date
+ * according to the recovery policy
+ */
+func (rd *RuleDriver) recoverDependencies() {
+	/* a paused rule's state is stale, find out what it is now, which may
+	 * change state, and take care of recovering on its own
+	 */
+	if rd.Rule.DependsMode == RuleDependsPause && !rd.isPaused() {
+		rd.realRun(time.Now())
+	}
+
+	if !rd.recovering {
+		return
+	}
+	rd.recovering = false
+
+	/* left to the end of the window */
+	if !rd.maintenanceUntil.IsZero() {
+		log.Info("'%s' dependencies recovered in a maintenance window, nothing to do until it ends", rd.Rule.Name)
+		return
+	}
+
+	state := rd.Rule.LastState
+	if state == RuleStateUnknown {
+		return
+	}
+
+	previous := rd.changeState.state()
+
+	switch rd.Rule.DependsRecovery {
+	case RuleRecoveryNone:
+		return
+	case RuleRecoveryReconcile:
+		if previous == state {
+			log.Debug("'%s' run %s dependencies recovered, change commands up to date", rd.Rule.Name, rd.GetRunUid())
+			return
+		}
+	}
+
+	log.Info("'%s' run %s dependencies recovered, running change command for %v", rd.Rule.Name, rd.GetRunUid(), state)
+	rd.change(state, rd.changeEnv(previous, state))
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "io/ioutil"
+import "os"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+func TestDependenciesBlocking(t *testing.T) {
+	d := NewDependencies()
+
+	d.set("switch", dependencyState{State: RuleStateSuccess})
+	d.set("router", dependencyState{State: RuleStateSuccess, Blocked: "uplink"})
+
+	if blocked, changed := d.blocking([]string{"switch", "unknown"}); blocked != "" || changed == nil {
+		t.Errorf("Expected nothing blocking, and a channel to wait on, got: '%s'", blocked)
+	}
+
+	if blocked, _ := d.blocking([]string{"switch", "router"}); blocked != "router" {
+		t.Errorf("Expected a blocked dependency to block, got: '%s'", blocked)
+	}
+
+	_, changed := d.blocking([]string{"switch"})
+	d.set("switch", dependencyState{State: RuleStateFail})
+
+	select {
+	case <-changed:
+	default:
+		t.Errorf("Expected a change to be signalled")
+	}
+
+	if blocked, _ := d.blocking([]string{"switch"}); blocked != "switch" {
+		t.Errorf("Expected a failed dependency to block, got: '%s'", blocked)
+	}
+
+	if blocked, changed := d.blocking(nil); blocked != "" || changed != nil {
+		t.Errorf("Expected nothing to wait on without dependencies")
+	}
+}
+
+/* a driver for child, depending on parent, whose change commands log the
+ * state to a file
+ */
+func newDependentDriver(t *testing.T, cfg string, logFile string) (*RuleDriver, chan *RuleDriver) {
+	var c Configuration
+
+	script := `echo $HFM_NEW_STATE >> ` + logFile
+
+	cfg = `parent { test="true" } child { depends_on="parent"; interval=0.05; change_fail="/bin/sh"; change_fail_arguments=["-c", "` + script + `"]; change_success="/bin/sh"; change_success_arguments=["-c", "` + script + `"]; ` + cfg + ` }`
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	done := make(chan *RuleDriver)
+	return NewRuleDriver(*c.Rules["child"], done, 0), done
+}
+
+/* wait up to a second for cond */
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func readStateLog(logFile string) []string {
+	out, _ := ioutil.ReadFile(logFile)
+	if len(out) == 0 {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func TestDriverDependsSuppress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	deps := NewDependencies()
+	deps.set("parent", dependencyState{State: RuleStateFail})
+
+	driver, done := newDependentDriver(t, `test="false"`, dir+"/log")
+	driver.deps = deps
+	go driver.Run()
+
+	if !waitFor(func() bool { s := driver.Snapshot(); return s.Rule.LastState == RuleStateFail && s.Count > 2 }) {
+		t.Fatalf("Expected the rule to keep running, and fail")
+	}
+
+	if s := driver.Snapshot(); s.Blocked != "parent" {
+		t.Errorf("Expected the rule to be blocked by parent, got: '%s'", s.Blocked)
+	}
+
+	if got := readStateLog(dir + "/log"); got != nil {
+		t.Errorf("Expected change commands to be suppressed, got: %v", got)
+	}
+
+	// the child should be held back in turn
+	if blocked, _ := deps.blocking([]string{"child"}); blocked != "child" {
+		t.Errorf("Expected the child to block its own dependents")
+	}
+
+	deps.set("parent", dependencyState{State: RuleStateSuccess})
+
+	expected := []string{"fail"}
+	if !waitFor(func() bool { return reflect.DeepEqual(readStateLog(dir+"/log"), expected) }) {
+		t.Errorf("Expected change commands %v once recovered, got: %v", expected, readStateLog(dir+"/log"))
+	}
+
+	driver.Stop()
+	<-done
+}
+
+func TestDriverDependsPause(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	deps := NewDependencies()
+	deps.set("parent", dependencyState{State: RuleStateFail})
+
+	driver, done := newDependentDriver(t, `test="true"; depends_mode="pause"`, dir+"/log")
+	driver.deps = deps
+	go driver.Run()
+
+	time.Sleep(200 * time.Millisecond)
+	if s := driver.Snapshot(); s.Count != 0 || s.Blocked != "parent" {
+		t.Errorf("Expected no runs while blocked, got %d runs, blocked by '%s'", s.Count, s.Blocked)
+	}
+
+	deps.set("parent", dependencyState{State: RuleStateSuccess})
+
+	expected := []string{"success"}
+	if !waitFor(func() bool { return reflect.DeepEqual(readStateLog(dir+"/log"), expected) }) {
+		t.Errorf("Expected change commands %v once recovered, got: %v", expected, readStateLog(dir+"/log"))
+	}
+
+	driver.Stop()
+	<-done
+}
+
+func TestDriverDependsRecoveryNone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	deps := NewDependencies()
+	deps.set("parent", dependencyState{State: RuleStateFail})
+
+	driver, done := newDependentDriver(t, `test="false"; depends_recovery="none"`, dir+"/log")
+	driver.deps = deps
+	go driver.Run()
+
+	if !waitFor(func() bool { return driver.Snapshot().Rule.LastState == RuleStateFail }) {
+		t.Fatalf("Expected the rule to fail")
+	}
+
+	deps.set("parent", dependencyState{State: RuleStateSuccess})
+
+	if !waitFor(func() bool { return driver.Snapshot().Blocked == "" }) {
+		t.Fatalf("Expected the rule to recover")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if got := readStateLog(dir + "/log"); got != nil {
+		t.Errorf("Expected no change commands on recovery, got: %v", got)
+	}
+
+	driver.Stop()
+	<-done
+}
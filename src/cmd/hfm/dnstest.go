@@ -0,0 +1,447 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* definitions */
+
+/* the record types we know how to ask for, and present answers for */
+var dnsTypes = map[string]uint16{
+	"A":     1,
+	"NS":    2,
+	"CNAME": 5,
+	"SOA":   6,
+	"PTR":   12,
+	"MX":    15,
+	"TXT":   16,
+	"AAAA":  28,
+	"SRV":   33,
+}
+
+/* the response codes we can be told to expect */
+var dnsRcodes = map[string]int{
+	"NOERROR":  0,
+	"FORMERR":  1,
+	"SERVFAIL": 2,
+	"NXDOMAIN": 3,
+	"NOTIMP":   4,
+	"REFUSED":  5,
+}
+
+const (
+	dnsClassIN = 1
+	/* how long to wait for an answer, when the rule doesn't say */
+	dnsDefaultTimeout = 5 * time.Second
+	/* the largest udp response we'll accept */
+	dnsMaxUDPSize = 4096
+)
+
+/* the parts of a response the test cares about */
+type dnsResponse struct {
+	Rcode     int
+	Truncated bool
+	/* the answers of the type asked for, in presentation form */
+	Answers []string
+}
+
+/* meat */
+
+/* build a recursive query for a single question */
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	/* recursion desired */
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	/* one question */
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid name: %q", name)
+			}
+
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	msg = append(msg, 0)
+
+	if len(msg) > 12+255 {
+		return nil, fmt.Errorf("name too long: %q", name)
+	}
+
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+
+	return msg, nil
+}
+
+/* read a possibly compressed name at off, returning it, and the offset
+ * following it
+ */
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+
+	/* each pointer must go backwards, so this bounds the loop */
+	for hops := 0; hops < len(msg); hops++ {
+		if off >= len(msg) {
+			return "", 0, errors.New("name overruns message")
+		}
+
+		l := int(msg[off])
+		switch l & 0xC0 {
+		case 0x00:
+			if l == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return strings.Join(labels, ".") + ".", next, nil
+			}
+
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("label overruns message")
+			}
+
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		case 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("pointer overruns message")
+			}
+
+			ptr := int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			if ptr >= off {
+				return "", 0, errors.New("name pointer doesn't point backwards")
+			}
+
+			if next < 0 {
+				next = off + 2
+			}
+			off = ptr
+		default:
+			return "", 0, errors.New("unsupported label type")
+		}
+	}
+
+	return "", 0, errors.New("name pointers loop")
+}
+
+/* present record data the way zone files do */
+func formatDNSRecord(msg []byte, rtype uint16, off int, rdlen int) (string, error) {
+	rdata := msg[off : off+rdlen]
+
+	/* names in rdata may be compressed against the whole message */
+	name := func(at int) (string, int, error) {
+		n, end, err := readDNSName(msg, off+at)
+		return n, end - off, err
+	}
+
+	switch rtype {
+	case dnsTypes["A"], dnsTypes["AAAA"]:
+		if len(rdata) != net.IPv4len && len(rdata) != net.IPv6len {
+			return "", errors.New("invalid address length")
+		}
+		return net.IP(rdata).String(), nil
+	case dnsTypes["NS"], dnsTypes["CNAME"], dnsTypes["PTR"]:
+		n, _, err := name(0)
+		return n, err
+	case dnsTypes["MX"]:
+		if len(rdata) < 3 {
+			return "", errors.New("short mx record")
+		}
+		n, _, err := name(2)
+		return strconv.Itoa(int(binary.BigEndian.Uint16(rdata))) + " " + n, err
+	case dnsTypes["SRV"]:
+		if len(rdata) < 7 {
+			return "", errors.New("short srv record")
+		}
+		n, _, err := name(6)
+		return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]), binary.BigEndian.Uint16(rdata[4:]), n), err
+	case dnsTypes["TXT"]:
+		var parts []string
+		for i := 0; i < len(rdata); {
+			l := int(rdata[i])
+			if i+1+l > len(rdata) {
+				return "", errors.New("short txt record")
+			}
+			parts = append(parts, string(rdata[i+1:i+1+l]))
+			i += 1 + l
+		}
+		return strings.Join(parts, ""), nil
+	case dnsTypes["SOA"]:
+		mname, at, err := name(0)
+		if err != nil {
+			return "", err
+		}
+		rname, at, err := name(at)
+		if err != nil {
+			return "", err
+		}
+		if at+20 > len(rdata) {
+			return "", errors.New("short soa record")
+		}
+		tmp := []string{mname, rname}
+		for i := 0; i < 5; i++ {
+			tmp = append(tmp, strconv.FormatUint(uint64(binary.BigEndian.Uint32(rdata[at+i*4:])), 10))
+		}
+		return strings.Join(tmp, " "), nil
+	}
+
+	return "", fmt.Errorf("unsupported record type %d", rtype)
+}
+
+/* parse the response to our query, keeping the answers of the type asked */
+func parseDNSResponse(msg []byte, id uint16, qtype uint16) (*dnsResponse, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("short response")
+	}
+
+	if binary.BigEndian.Uint16(msg) != id {
+		return nil, errors.New("response id doesn't match the query")
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, errors.New("received a query, not a response")
+	}
+
+	resp := &dnsResponse{
+		Rcode:     int(flags & 0x000F),
+		Truncated: flags&0x0200 != 0,
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+
+	for i := 0; i < qdcount; i++ {
+		_, end, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = end + 4
+	}
+
+	for i := 0; i < ancount; i++ {
+		_, end, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+
+		off = end
+		if off+10 > len(msg) {
+			return nil, errors.New("answer overruns message")
+		}
+
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+
+		if off+rdlen > len(msg) {
+			return nil, errors.New("record overruns message")
+		}
+
+		/* skip the cnames, etc. that led us to the answer */
+		if rtype == qtype && class == dnsClassIN {
+			answer, err := formatDNSRecord(msg, rtype, off, rdlen)
+			if err != nil {
+				return nil, err
+			}
+			resp.Answers = append(resp.Answers, answer)
+		}
+
+		off += rdlen
+	}
+
+	return resp, nil
+}
+
+/* send the query over an established connection, and wait for the answer */
+func exchangeDNS(ctx context.Context, protocol string, server string, query []byte, deadline time.Time) ([]byte, error) {
+	d := net.Dialer{Deadline: deadline}
+
+	conn, err := d.DialContext(ctx, protocol, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer closeWhenDone(ctx, conn)()
+
+	conn.SetDeadline(deadline)
+
+	if protocol == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, dnsMaxUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+
+	/* tcp messages are prefixed by their length */
+	framed := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+/* the names in answers are compared without regard to case, or the trailing
+ * dot
+ */
+func normalizeDNSAnswer(s string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+}
+
+/* query DNSServer, and check the response against what's expected */
+func runDNSTest(ctx context.Context, rd *RuleDriver, deadline time.Time) error {
+	qtype, ok := dnsTypes[rd.Rule.DNSType]
+	if !ok {
+		qtype = dnsTypes["A"]
+	}
+
+	server := rd.Rule.DNSServer
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	/* without a deadline, a lost datagram would wait forever */
+	if deadline.IsZero() {
+		timeout := rd.Rule.ConnectTimeout
+		if timeout == 0 {
+			timeout = dnsDefaultTimeout
+		}
+		deadline = time.Now().Add(timeout)
+	}
+
+	id := uint16(rand.Intn(0x10000))
+	query, err := buildDNSQuery(id, rd.Rule.DNSName, qtype)
+	if err != nil {
+		return err
+	}
+
+	protocol := rd.Rule.DNSProtocol
+	if protocol == "" {
+		protocol = "udp"
+	}
+
+	msg, err := exchangeDNS(ctx, protocol, server, query, deadline)
+	if err != nil {
+		return err
+	}
+
+	resp, err := parseDNSResponse(msg, id, qtype)
+	if err != nil {
+		return err
+	}
+
+	/* like a resolver, retry a truncated answer over tcp */
+	if resp.Truncated && protocol == "udp" {
+		if msg, err = exchangeDNS(ctx, "tcp", server, query, deadline); err != nil {
+			return err
+		}
+
+		if resp, err = parseDNSResponse(msg, id, qtype); err != nil {
+			return err
+		}
+	}
+
+	if resp.Rcode != rd.Rule.ExpectRcode {
+		return fmt.Errorf("expected rcode %d, received %d", rd.Rule.ExpectRcode, resp.Rcode)
+	}
+
+	if len(resp.Answers) < int(rd.Rule.MinAnswers) {
+		return fmt.Errorf("expected at least %d answers, received %d: %v", rd.Rule.MinAnswers, len(resp.Answers), resp.Answers)
+	}
+
+	received := make(map[string]bool)
+	for _, a := range resp.Answers {
+		received[normalizeDNSAnswer(a)] = true
+	}
+
+	expected := make(map[string]bool)
+	for _, a := range rd.Rule.ExpectAnswers {
+		a = normalizeDNSAnswer(a)
+		expected[a] = true
+
+		if !received[a] {
+			return fmt.Errorf("expected answer %q, received: %v", a, resp.Answers)
+		}
+	}
+
+	if rd.Rule.ExpectAnswersExact {
+		var extra []string
+		for a := range received {
+			if !expected[a] {
+				extra = append(extra, a)
+			}
+		}
+
+		if len(extra) > 0 {
+			sort.Strings(extra)
+			return fmt.Errorf("received unexpected answers: %v", extra)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "net"
+import "strings"
+import "testing"
+
+/* answers queries for a tiny, fixed zone, truncating big.test. over udp */
+func answerDNS(query []byte, udp bool) []byte {
+	name, end, err := readDNSName(query, 12)
+	if err != nil {
+		return nil
+	}
+
+	resp := append([]byte{}, query[:end+4]...)
+	/* a response, recursion available */
+	resp[2] |= 0x80
+	resp[3] = 0x80
+	resp[6], resp[7] = 0, 0
+
+	type rr struct {
+		rtype uint16
+		rdata []byte
+	}
+
+	var answers []rr
+	switch name {
+	case "ok.test.":
+		/* points back to the question name, which is at offset 12 */
+		answers = []rr{
+			{dnsTypes["CNAME"], []byte{0xC0, 12}},
+			{dnsTypes["A"], []byte{10, 0, 0, 1}},
+			{dnsTypes["A"], []byte{10, 0, 0, 2}},
+			{dnsTypes["MX"], []byte{0, 10, 2, 'm', 'x', 0xC0, 12}},
+		}
+	case "big.test.":
+		if udp {
+			resp[2] |= 0x02
+			break
+		}
+		answers = []rr{{dnsTypes["A"], []byte{10, 0, 0, 3}}}
+	default:
+		resp[3] |= byte(dnsRcodes["NXDOMAIN"])
+	}
+
+	for _, a := range answers {
+		resp = append(resp, 0xC0, 12, byte(a.rtype>>8), byte(a.rtype), 0, dnsClassIN, 0, 0, 0, 60, 0, byte(len(a.rdata)))
+		resp = append(resp, a.rdata...)
+		resp[7]++
+	}
+
+	return resp
+}
+
+func startDNSServer(t *testing.T) (func(), string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(answerDNS(buf[:n], true), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				buf := make([]byte, 514)
+				n, err := conn.Read(buf)
+				if err != nil || n < 2 {
+					return
+				}
+
+				resp := answerDNS(buf[2:n], false)
+				conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+			}(conn)
+		}
+	}()
+
+	return func() { pc.Close(); l.Close() }, pc.LocalAddr().String()
+}
+
+func TestNativeDNSAnswers(t *testing.T) {
+	stop, addr := startDNSServer(t)
+	defer stop()
+
+	driver := runNativeRule(t, `runs=1; test_type="dns"; dns_server="`+addr+`"; dns_name="ok.test"; min_answers=2; expect_answers=["10.0.0.2"]`)
+	if driver.Last.ExitStatus != 0 || driver.Rule.LastState != RuleStateSuccess {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="dns"; dns_server="`+addr+`"; dns_name="ok.test"; min_answers=3`)
+	if driver.Last.ExitStatus != 1 {
+		t.Errorf("Expected failure for too few answers, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="dns"; dns_server="`+addr+`"; dns_name="ok.test"; expect_answers=["10.0.0.1"]; expect_answers_exact=true`)
+	if driver.Last.ExitStatus != 1 || !strings.Contains(driver.Last.Error.Error(), "10.0.0.2") {
+		t.Errorf("Expected failure for an unexpected answer, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="dns"; dns_server="`+addr+`"; dns_protocol="tcp"; dns_name="ok.test"; dns_type="mx"; expect_answers=["10 mx.ok.test."]; expect_answers_exact=true`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeDNSRcode(t *testing.T) {
+	stop, addr := startDNSServer(t)
+	defer stop()
+
+	driver := runNativeRule(t, `runs=1; test_type="dns"; dns_server="`+addr+`"; dns_name="missing.test"`)
+	if driver.Last.ExitStatus != 1 {
+		t.Errorf("Expected failure, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="dns"; dns_server="`+addr+`"; dns_name="missing.test"; expect_rcode="nxdomain"`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeDNSTruncated(t *testing.T) {
+	stop, addr := startDNSServer(t)
+	defer stop()
+
+	driver := runNativeRule(t, `runs=1; test_type="dns"; dns_server="`+addr+`"; dns_name="big.test"; expect_answers=["10.0.0.3"]`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success over tcp, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeDNSTimeout(t *testing.T) {
+	// nothing answers datagrams sent here
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer pc.Close()
+
+	driver := runNativeRule(t, `runs=1; test_type="dns"; dns_server="`+pc.LocalAddr().String()+`"; dns_name="ok.test"; timeout_int=50ms`)
+	if driver.Last.ExitStatus != 1 || !driver.Last.Interrupted {
+		t.Errorf("Expected failure by timeout, received: %+v\n", driver.Last)
+	}
+}
+
+func TestReadDNSNameLoop(t *testing.T) {
+	msg := make([]byte, 14)
+	msg[12], msg[13] = 0xC0, 12
+
+	if _, _, err := readDNSName(msg, 12); err == nil {
+		t.Errorf("Expected error for a name pointing to itself")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+/* definitions */
+
+/* values below 2^latencySubBucketBits nanoseconds are recorded exactly,
+ * larger values keep latencySubBucketBits of precision, which bounds the
+ * error to under 2%
+ */
+const latencySubBucketBits = 7
+const latencySubBucketCount = 1 << latencySubBucketBits
+const latencySubBucketHalf = latencySubBucketCount / 2
+
+/* An HDR style histogram of durations.  Buckets are linear within each power
+ * of two, and allocated as values arrive, so memory is proportional to the
+ * magnitude of the largest value recorded.
+ */
+type LatencyHistogram struct {
+	counts []uint64
+	total  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+/* the percentiles we report, corrected and uncorrected */
+type LatencyPercentiles struct {
+	Count uint64
+	Sum   time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+	Max   time.Duration
+}
+
+/* meat */
+
+func latencyIndex(v uint64) int {
+	if v < latencySubBucketCount {
+		return int(v)
+	}
+
+	shift := uint(bits.Len64(v)) - latencySubBucketBits
+	return int(shift)*latencySubBucketHalf + int(v>>shift)
+}
+
+/* the largest value that would be recorded in the bucket at index i */
+func latencyHighestEquivalent(i int) uint64 {
+	if i < latencySubBucketCount {
+		return uint64(i)
+	}
+
+	shift := uint(i/latencySubBucketHalf - 1)
+	sub := uint64(i%latencySubBucketHalf + latencySubBucketHalf)
+
+	return (sub+1)<<shift - 1
+}
+
+func (h *LatencyHistogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	i := latencyIndex(uint64(d))
+	if i >= len(h.counts) {
+		counts := make([]uint64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+
+	h.counts[i]++
+	h.total++
+	h.sum += d
+
+	if d > h.max {
+		h.max = d
+	}
+}
+
+/* Record d, and if it overshot the expected interval between samples, the
+ * samples that would have been taken had we not been waiting on this one.
+ * This is what corrects for coordinated omission.
+ */
+func (h *LatencyHistogram) RecordCorrected(d time.Duration, expectedInterval time.Duration) {
+	h.Record(d)
+
+	if expectedInterval <= 0 {
+		return
+	}
+
+	for missing := d - expectedInterval; missing >= expectedInterval; missing -= expectedInterval {
+		h.Record(missing)
+	}
+}
+
+/* the value that q (0..1) of the recorded values are at or below */
+func (h *LatencyHistogram) ValueAtQuantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(q * float64(h.total)))
+	if target < 1 {
+		target = 1
+	}
+
+	var seen uint64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= target {
+			v := time.Duration(latencyHighestEquivalent(i))
+			if v > h.max {
+				v = h.max
+			}
+			return v
+		}
+	}
+
+	return h.max
+}
+
+func (h *LatencyHistogram) Percentiles() LatencyPercentiles {
+	return LatencyPercentiles{
+		Count: h.total,
+		Sum:   h.sum,
+		P50:   h.ValueAtQuantile(0.5),
+		P90:   h.ValueAtQuantile(0.9),
+		P99:   h.ValueAtQuantile(0.99),
+		P999:  h.ValueAtQuantile(0.999),
+		Max:   h.max,
+	}
+}
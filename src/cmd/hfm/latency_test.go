@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "testing"
+import "time"
+
+func TestLatencyIndexRoundTrip(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 129, 255, 256, 1000, 123456789, 1 << 40} {
+		i := latencyIndex(v)
+		h := latencyHighestEquivalent(i)
+
+		if h < v {
+			t.Errorf("Value %d in bucket %d, which tops out at %d", v, i, h)
+		}
+
+		if v >= latencySubBucketCount && float64(h-v)/float64(v) > 0.02 {
+			t.Errorf("Value %d in bucket %d, which tops out at %d, more than 2%% error", v, i, h)
+		}
+
+		if i > 0 && latencyHighestEquivalent(i-1) >= v {
+			t.Errorf("Value %d should have been in an earlier bucket than %d", v, i)
+		}
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	var h LatencyHistogram
+
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	p := h.Percentiles()
+
+	within := func(name string, got time.Duration, exp time.Duration) {
+		if got < exp || float64(got-exp)/float64(exp) > 0.02 {
+			t.Errorf("%s: expected about %v, got %v", name, exp, got)
+		}
+	}
+
+	within("p50", p.P50, 500*time.Millisecond)
+	within("p90", p.P90, 900*time.Millisecond)
+	within("p99", p.P99, 990*time.Millisecond)
+	within("p99.9", p.P999, 999*time.Millisecond)
+
+	if p.Max != time.Second || p.Count != 1000 {
+		t.Errorf("Unexpected max or count: %+v", p)
+	}
+}
+
+func TestLatencyCorrected(t *testing.T) {
+	var h LatencyHistogram
+
+	// a single 1s stall, with runs expected every 100ms, hides 9 runs that
+	// would have waited 900ms, 800ms, ... 100ms
+	h.RecordCorrected(time.Second, 100*time.Millisecond)
+
+	if h.total != 10 {
+		t.Errorf("Expected 10 values after correction, got: %d", h.total)
+	}
+
+	if p := h.ValueAtQuantile(0.5); p < 500*time.Millisecond || p > 510*time.Millisecond {
+		t.Errorf("Expected a corrected median of about 500ms, got %v", p)
+	}
+
+	// no expected interval, nothing to correct
+	h = LatencyHistogram{}
+	h.RecordCorrected(time.Second, 0)
+	if h.total != 1 {
+		t.Errorf("Expected 1 value without correction, got: %d", h.total)
+	}
+}
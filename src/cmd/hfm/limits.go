@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"sync"
+)
+
+/* definitions */
+
+/* How many test processes may run at once, overall and by group.  A nil
+ * semaphore is unlimited.
+ */
+type TestLimits struct {
+	sync.Mutex
+
+	global chan struct{}
+
+	/* string maps to group name */
+	groups map[string]chan struct{}
+}
+
+/* meat */
+
+func NewTestLimits() *TestLimits {
+	return &TestLimits{groups: make(map[string]chan struct{})}
+}
+
+/* a semaphore of the given size, reusing sem if it is already that size */
+func resizeSemaphore(sem chan struct{}, size int) chan struct{} {
+	switch {
+	case size == 0:
+		return nil
+	case sem != nil && cap(sem) == size:
+		return sem
+	}
+
+	return make(chan struct{}, size)
+}
+
+/* Set the limits, 0 for none.  Processes already running count against the
+ * limit they started under, until they exit.
+ */
+func (l *TestLimits) configure(global int, groups map[string]int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.global = resizeSemaphore(l.global, global)
+
+	for name, sem := range l.groups {
+		if groups[name] == 0 {
+			delete(l.groups, name)
+			continue
+		}
+
+		l.groups[name] = resizeSemaphore(sem, groups[name])
+	}
+
+	for name, size := range groups {
+		if _, ok := l.groups[name]; !ok && size > 0 {
+			l.groups[name] = resizeSemaphore(nil, size)
+		}
+	}
+}
+
+/* Wait for a slot in the group, and overall, safe to call on nil.  Returns
+ * a function to give them back, or false if quit closed first.
+ */
+func (l *TestLimits) acquire(group string, quit <-chan struct{}) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+
+	l.Lock()
+	sems := []chan struct{}{l.groups[group], l.global}
+	l.Unlock()
+
+	var held []chan struct{}
+	release := func() {
+		for _, sem := range held {
+			<-sem
+		}
+	}
+
+	/* group first, so we don't hold an overall slot while our group is
+	 * full
+	 */
+	for _, sem := range sems {
+		if sem == nil {
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+			held = append(held, sem)
+		case <-quit:
+			release()
+			return nil, false
+		}
+	}
+
+	return release, true
+}
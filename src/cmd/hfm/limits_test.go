@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "testing"
+import "time"
+
+func TestTestLimitsAcquire(t *testing.T) {
+	l := NewTestLimits()
+	l.configure(2, map[string]int{"db": 1})
+
+	quit := make(chan struct{})
+
+	release, ok := l.acquire("db", quit)
+	if !ok {
+		t.Fatalf("Expected a slot for the first run")
+	}
+
+	if _, ok := l.acquire("web", quit); !ok {
+		t.Fatalf("Expected a slot for another group")
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		_, ok := l.acquire("db", quit)
+		acquired <- ok
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("Expected the group limit to hold the run back")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+
+	if ok := <-acquired; !ok {
+		t.Errorf("Expected a slot once released")
+	}
+
+	// both the group and overall limit are full now
+	close(quit)
+	if _, ok := l.acquire("web", quit); ok {
+		t.Errorf("Expected to give up waiting once asked to stop")
+	}
+
+	var nilLimits *TestLimits
+	if release, ok := nilLimits.acquire("db", nil); !ok {
+		t.Errorf("Expected no limit without limits")
+	} else {
+		release()
+	}
+}
+
+func TestDriverSchedulingDelay(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`max_concurrent_tests=1; g { group_max_concurrent_tests=5; r1 { test="sleep"; test_arguments=["0.2"]; runs=1 } r2 { test="true"; runs=1 } }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	if c.MaxConcurrentTests != 1 || c.Rules["g/r2"].GroupMaxConcurrentTests != 5 {
+		t.Errorf("Expected limits of 1 overall, and 5 for the group, got %d, and %d", c.MaxConcurrentTests, c.Rules["g/r2"].GroupMaxConcurrentTests)
+	}
+
+	limits := NewTestLimits()
+	limits.configure(c.MaxConcurrentTests, nil)
+
+	ruleDone := make(chan *RuleDriver)
+	r1 := NewRuleDriver(*c.Rules["g/r1"], ruleDone, 0)
+	r2 := NewRuleDriver(*c.Rules["g/r2"], ruleDone, 0)
+	r1.limits, r2.limits = limits, limits
+
+	go r1.Run()
+	time.Sleep(50 * time.Millisecond)
+	go r2.Run()
+	<-ruleDone
+	<-ruleDone
+
+	if s := r2.Snapshot(); s.LastSchedulingDelay < 100*time.Millisecond || s.LastExecDuration > 100*time.Millisecond {
+		t.Errorf("Expected the second run to wait for the first, not counting it against the run, waited %v, ran %v", s.LastSchedulingDelay, s.LastExecDuration)
+	}
+
+	for _, config := range []string{`g { max_concurrent_tests=1; r1 { test="true" } }`, `g { r1 { test="true"; group_max_concurrent_tests=1 } }`} {
+		if e := c.SetConfiguration(config); e == nil {
+			t.Errorf("Expected error for a limit in the wrong place: %s", config)
+		}
+	}
+}
@@ -124,12 +124,21 @@ func main() {
 	var config Configuration
 
 	var lc LogConfiguration
+	var shutdownInt, shutdownKill time.Duration
+	var controlPath string
+	var metricsAddr string
+	var statePath string
 
 	version := flag.Bool("v", false, "Print hfm version")
 	testOnly := flag.Bool("n", false, "Print hfm version")
 	flag.StringVar(&configPath, "config", build_etcdir+"/hfm.conf", "Configuration file path")
 	flag.StringVar(&lc.Where, "log", "stderr", "Where to log {stderr, syslog}")
 	flag.StringVar(&lc.Facility, "facility", "local0", "Log facility (when -log set to syslog) {local0-9, user, etc}")
+	flag.StringVar(&controlPath, "control", "", "Path to listen on for control requests from hfmctl, empty to disable")
+	flag.StringVar(&metricsAddr, "metrics", "", "Address to serve prometheus metrics on, for example :9153, empty to disable")
+	flag.StringVar(&statePath, "state", "", "Path to keep rule state in across restarts, empty to disable")
+	flag.DurationVar(&shutdownInt, "grace", 5*time.Second, "On shutdown, time allowed for running tests and change commands before they are interrupted, 0 to never interrupt")
+	flag.DurationVar(&shutdownKill, "grace-kill", 10*time.Second, "On shutdown, time allowed for running tests and change commands before they are killed, 0 to never kill")
 	flag.Parse()
 
 	if *version {
@@ -155,29 +164,45 @@ func main() {
 		panic(e)
 	}
 
-	ruleDone := make(chan *RuleDriver)
-
 	/* close enough for most applications */
 	appInstance := uint64(time.Now().UnixNano()) - HFM_EPOCH
 
 	log.Info("Loaded %d rules.", len(config.Rules))
 	log.Debug("%d goroutines - before main dispatch loop.", runtime.NumGoroutine())
 
-	/* dispatch rules that are scheduled to start at this interval */
-	for _, rule := range config.Rules {
-		log.Debug("Dispatching rule '%s'", rule.Name)
-		log.Debug("%s details: %+v", rule.Name, rule)
+	/* dispatch rules, and keep them in line with the configuration until
+	 * they have all completed
+	 */
+	cl := NewControlLoop(configPath, appInstance)
+	cl.ShutdownInt = shutdownInt
+	cl.ShutdownKill = shutdownKill
+
+	if statePath != "" {
+		sf, e := LoadStateFile(statePath)
+		if e != nil {
+			fmt.Printf("Could not load state file %v: %v\n\n", statePath, e)
+			panic(e)
+		}
+		cl.State = sf
+	}
 
-		// driver gets its own copy of the rule, safe from
-		// side effects later
-		driver := RuleDriver{Rule: *rule, Done: ruleDone, AppInstance: appInstance}
-		go driver.Run()
+	if controlPath != "" {
+		if e := cl.ListenControl(controlPath); e != nil {
+			fmt.Printf("Could not listen on control socket %v: %v\n\n", controlPath, e)
+			panic(e)
+		}
+		defer os.Remove(controlPath)
 	}
 
-	for i := 0; i < len(config.Rules); i++ {
-		driver := <-ruleDone
-		log.Info("'%s' completed execution.  Ran for: %v\n\n", driver.Rule.Name, driver.Last.ExecDuration)
+	if metricsAddr != "" {
+		if e := cl.Metrics.Listen(metricsAddr); e != nil {
+			fmt.Printf("Could not listen for metrics on %v: %v\n\n", metricsAddr, e)
+			panic(e)
+		}
 	}
 
+	cl.ApplyConfiguration(&config)
+	cl.Run()
+
 	log.Debug("%d goroutines - at the end.", runtime.NumGoroutine())
 }
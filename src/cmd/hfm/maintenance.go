@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* definitions */
+
+/* A time range the rule's change commands are suppressed in.  Either from
+ * start until end, or for duration each time schedule comes around.
+ */
+type maintenanceWindow struct {
+	start, end time.Time
+
+	schedule *Schedule
+	duration time.Duration
+}
+
+/* the formats absolute times may be given in, without a zone, local to the
+ * rule's timezone
+ */
+var maintenanceTimeFormats = []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02 15:04:05"}
+
+/* meat */
+
+/* Parse a maintenance window, in the time zone loc, which is one of:
+ *
+ *   - "<start> to <end>", with times as RFC 3339, or "2006-01-02 15:04"
+ *   - "<schedule> for <duration>", such as "sun at 02:00 for 2h"
+ */
+func parseMaintenanceWindow(s string, loc *time.Location) (maintenanceWindow, error) {
+	var w maintenanceWindow
+
+	if i := strings.LastIndex(s, " for "); i >= 0 {
+		sched, err := ParseSchedule(s[:i], loc)
+		if err != nil {
+			return w, err
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(s[i+len(" for "):]))
+		if err != nil || d <= 0 {
+			return w, fmt.Errorf("invalid duration in '%s'", s)
+		}
+
+		w.schedule = sched
+		w.duration = d
+
+		return w, nil
+	}
+
+	parts := strings.SplitN(s, " to ", 2)
+	if len(parts) != 2 {
+		return w, errors.New("expected '<start> to <end>', or '<schedule> for <duration>'")
+	}
+
+	var err error
+	if w.start, err = parseMaintenanceTime(parts[0], loc); err != nil {
+		return w, err
+	}
+	if w.end, err = parseMaintenanceTime(parts[1], loc); err != nil {
+		return w, err
+	}
+
+	if !w.end.After(w.start) {
+		return w, fmt.Errorf("ends before it starts in '%s'", s)
+	}
+
+	return w, nil
+}
+
+func parseMaintenanceTime(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	for _, format := range maintenanceTimeFormats {
+		if t, err := time.ParseInLocation(format, s, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time '%s'", s)
+}
+
+/* when the window now is in ends, or zero if now isn't in it */
+func (w *maintenanceWindow) until(now time.Time) time.Time {
+	if w.schedule == nil {
+		if !now.Before(w.start) && now.Before(w.end) {
+			return w.end
+		}
+
+		return time.Time{}
+	}
+
+	/* the latest start in the last duration, if windows overlap */
+	var end time.Time
+	for start := w.schedule.Next(now.Add(-w.duration)); !start.IsZero() && !start.After(now); start = w.schedule.Next(start) {
+		end = start.Add(w.duration)
+	}
+
+	return end
+}
+
+/* the rule's maintenance windows, in its time zone */
+func (rule *Rule) maintenanceWindows() ([]maintenanceWindow, error) {
+	loc, err := rule.location()
+	if err != nil {
+		return nil, err
+	}
+
+	var windows []maintenanceWindow
+	for _, s := range rule.Maintenance {
+		w, err := parseMaintenanceWindow(s, loc)
+		if err != nil {
+			return nil, err
+		}
+
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+/* Start a maintenance window lasting until the given time, or end the one
+ * started this way if until is zero.  Windows from the configuration are
+ * unaffected.  Safe to call from any goroutine.
+ */
+func (rd *RuleDriver) SetMaintenance(until time.Time) {
+	rd.control.Lock()
+	rd.control.maintenanceUntil = until
+	rd.control.Unlock()
+
+	select {
+	case rd.control.maintenanceChanged <- struct{}{}:
+	default:
+		// one is already pending
+	}
+}
+
+/* when the maintenance window now is in ends, the latest if in several, or
+ * zero if none
+ */
+func (rd *RuleDriver) maintenanceEnds(now time.Time) time.Time {
+	rd.control.Lock()
+	until := rd.control.maintenanceUntil
+	rd.control.Unlock()
+
+	if !now.Before(until) {
+		until = time.Time{}
+	}
+
+	for i := range rd.windows {
+		if end := rd.windows[i].until(now); end.After(until) {
+			until = end
+		}
+	}
+
+	return until
+}
+
+/* Catch up with maintenance windows, noting when one starts, and when the
+ * last ends, running the change command for the state if it has changed
+ * since the window started.
+ */
+func (rd *RuleDriver) checkMaintenance() {
+	now := time.Now()
+	until := rd.maintenanceEnds(now)
+
+	if until.Equal(rd.maintenanceUntil) {
+		return
+	}
+
+	if rd.maintenanceTimer != nil {
+		rd.maintenanceTimer.Stop()
+		rd.maintenanceTimer = nil
+		rd.maintenanceEnd = nil
+	}
+
+	switch {
+	case until.IsZero():
+		log.Info("'%s' maintenance window ended", rd.Rule.Name)
+		rd.maintenanceUntil = until
+		rd.reconcileMaintenance()
+	case rd.maintenanceUntil.IsZero():
+		log.Warning("'%s' in a maintenance window until %v, suppressing change commands", rd.Rule.Name, until)
+		rd.maintenanceState = rd.Rule.LastState
+		fallthrough
+	default:
+		rd.maintenanceUntil = until
+		rd.maintenanceTimer = time.NewTimer(until.Sub(now))
+		rd.maintenanceEnd = rd.maintenanceTimer.C
+	}
+
+	rd.publish()
+}
+
+/* the maintenance window is over, act on what changed during it */
+func (rd *RuleDriver) reconcileMaintenance() {
+	before, state := rd.maintenanceState, rd.Rule.LastState
+
+	switch {
+	case state == before, state == RuleStateUnknown:
+		log.Info("'%s' state unchanged during maintenance, nothing to do", rd.Rule.Name)
+		return
+	case rd.blocked != "":
+		log.Info("'%s' state changed during maintenance, leaving it until dependency '%s' recovers", rd.Rule.Name, rd.blocked)
+		return
+	}
+
+	log.Info("'%s' run %s state changed from %v to %v during maintenance, running change command", rd.Rule.Name, rd.GetRunUid(), before, state)
+	rd.change(state, rd.changeEnv(before, state))
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "io/ioutil"
+import "os"
+import "reflect"
+import "testing"
+import "time"
+
+func TestMaintenanceWindowUntil(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No time zone data: %v", err)
+	}
+
+	tests := []struct {
+		window string
+		now    time.Time
+		until  time.Time
+	}{
+		{"2024-03-01 22:00 to 2024-03-02 02:00", time.Date(2024, 3, 1, 23, 0, 0, 0, loc), time.Date(2024, 3, 2, 2, 0, 0, 0, loc)},
+		{"2024-03-01 22:00 to 2024-03-02 02:00", time.Date(2024, 3, 2, 2, 0, 0, 0, loc), time.Time{}},
+		{"2024-03-01T22:00:00Z to 2024-03-02T02:00:00Z", time.Date(2024, 3, 1, 21, 59, 0, 0, time.UTC), time.Time{}},
+		{"sun at 02:00 for 2h", time.Date(2024, 3, 3, 3, 30, 0, 0, loc), time.Date(2024, 3, 3, 4, 0, 0, 0, loc)},
+		{"sun at 02:00 for 2h", time.Date(2024, 3, 3, 1, 59, 0, 0, loc), time.Time{}},
+		{"sun at 02:00 for 2h", time.Date(2024, 3, 4, 3, 0, 0, 0, loc), time.Time{}},
+		// overlapping windows end with the last
+		{"*/10 * * * * for 15m", time.Date(2024, 3, 4, 3, 12, 0, 0, loc), time.Date(2024, 3, 4, 3, 25, 0, 0, loc)},
+	}
+
+	for _, test := range tests {
+		w, err := parseMaintenanceWindow(test.window, loc)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.window, err)
+			continue
+		}
+
+		if until := w.until(test.now); !until.Equal(test.until) {
+			t.Errorf("%s at %v: expected %v, got %v", test.window, test.now, test.until, until)
+		}
+	}
+
+	for _, bad := range []string{"tomorrow", "2024-03-02 02:00 to 2024-03-01 22:00", "daily at 02:00 for forever", "sometimes for 1h"} {
+		if _, err := parseMaintenanceWindow(bad, loc); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestDriverMaintenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver, done := newDependentDriver(t, `test="false"`, dir+"/log")
+	driver.SetMaintenance(time.Now().Add(time.Hour))
+	go driver.Run()
+
+	if !waitFor(func() bool { s := driver.Snapshot(); return s.Rule.LastState == RuleStateFail && s.Count > 2 }) {
+		t.Fatalf("Expected the rule to keep running, and fail")
+	}
+
+	if s := driver.Snapshot(); s.MaintenanceUntil.IsZero() {
+		t.Errorf("Expected the rule to be in a maintenance window")
+	}
+
+	if got := readStateLog(dir + "/log"); got != nil {
+		t.Errorf("Expected change commands to be suppressed, got: %v", got)
+	}
+
+	driver.SetMaintenance(time.Time{})
+
+	expected := []string{"fail"}
+	if !waitFor(func() bool { return reflect.DeepEqual(readStateLog(dir+"/log"), expected) }) {
+		t.Errorf("Expected change commands %v once the window ended, got: %v", expected, readStateLog(dir+"/log"))
+	}
+
+	driver.Stop()
+	<-done
+
+	var c Configuration
+	if e := c.SetConfiguration(`r1 { test="true"; maintenance=["sun at 02:00 for 2h", "2024-03-01 22:00 to soon"] }`); e == nil {
+		t.Errorf("Expected error for an invalid maintenance window")
+	}
+}
@@ -0,0 +1,471 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* definitions */
+
+/* upper bounds of the exec duration histogram buckets, in seconds */
+var execDurationBuckets = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30,
+}
+
+/* counters for a single rule */
+type ruleCounts struct {
+	Name      string
+	GroupName string
+
+	Runs            uint64
+	Failures        uint64
+	Warnings        uint64
+	TimeoutsInt     uint64
+	TimeoutsKill    uint64
+	ChangesSuccess  uint64
+	ChangesFail     uint64
+	ChangesWarning  uint64
+	State           RuleStateType
+	DurationCount   uint64
+	DurationSum     time.Duration
+	DurationBuckets []uint64
+
+	/* time runs spent waiting for max_concurrent_tests */
+	SchedulingDelayCount uint64
+	SchedulingDelaySum   time.Duration
+	SchedulingDelayMax   time.Duration
+
+	/* tls tests: as of the last run that saw a certificate */
+	CertSeen         bool
+	CertDaysToExpiry float64
+
+	/* coprocess tests: as last reported */
+	TestMetrics map[string]float64
+
+	/* change commands, by the state they were run for, and whether they
+	 * exited 0
+	 */
+	ChangeCommands      [4][2]uint64
+	ChangeTimeoutsInt   uint64
+	ChangeTimeoutsKill  uint64
+	ChangeDurationCount uint64
+	ChangeDurationSum   time.Duration
+}
+
+/* a rule's counters, kept across restarts of its driver */
+type RuleMetrics struct {
+	sync.Mutex
+
+	counts ruleCounts
+
+	/* from the start of each run, and with the runs crowded out by slow
+	 * ones back-filled
+	 */
+	latency          LatencyHistogram
+	latencyCorrected LatencyHistogram
+}
+
+/* every rule's metrics, exposed in the prometheus text format */
+type Metrics struct {
+	sync.Mutex
+
+	/* string maps to rule name */
+	rules map[string]*RuleMetrics
+}
+
+/* meat */
+
+func NewMetrics() *Metrics {
+	return &Metrics{rules: make(map[string]*RuleMetrics)}
+}
+
+/* the metrics for a rule, created if they don't exist */
+func (m *Metrics) rule(name string, group string) *RuleMetrics {
+	m.Lock()
+	defer m.Unlock()
+
+	rm, ok := m.rules[name]
+	if !ok {
+		rm = &RuleMetrics{counts: ruleCounts{Name: name, DurationBuckets: make([]uint64, len(execDurationBuckets))}}
+		m.rules[name] = rm
+	}
+
+	rm.Lock()
+	rm.counts.GroupName = group
+	rm.Unlock()
+
+	return rm
+}
+
+func (m *Metrics) remove(name string) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.rules, name)
+}
+
+/* account for a completed run, safe to call on nil */
+func (rm *RuleMetrics) observeRun(last ExitRecord, state RuleStateType) {
+	if rm == nil {
+		return
+	}
+
+	rm.Lock()
+	defer rm.Unlock()
+
+	rm.counts.Runs++
+	switch last.State {
+	case RuleStateFail:
+		rm.counts.Failures++
+	case RuleStateWarning:
+		rm.counts.Warnings++
+	}
+
+	if last.Interrupted {
+		rm.counts.TimeoutsInt++
+	}
+
+	if last.Killed {
+		rm.counts.TimeoutsKill++
+	}
+
+	if last.stateChanged {
+		switch state {
+		case RuleStateSuccess:
+			rm.counts.ChangesSuccess++
+		case RuleStateFail:
+			rm.counts.ChangesFail++
+		case RuleStateWarning:
+			rm.counts.ChangesWarning++
+		}
+	}
+	rm.counts.State = state
+
+	if !last.CertNotAfter.IsZero() {
+		rm.counts.CertSeen = true
+		rm.counts.CertDaysToExpiry = last.CertDaysToExpiry
+	}
+
+	/* never modified once recorded, so shared */
+	if last.Metrics != nil {
+		rm.counts.TestMetrics = last.Metrics
+	}
+
+	rm.counts.DurationCount++
+	rm.counts.DurationSum += last.ExecDuration
+
+	seconds := last.ExecDuration.Seconds()
+	for i, le := range execDurationBuckets {
+		if seconds <= le {
+			rm.counts.DurationBuckets[i]++
+		}
+	}
+}
+
+/* account for a completed change command, safe to call on nil */
+func (rm *RuleMetrics) observeChange(rec ChangeRecord) {
+	if rm == nil {
+		return
+	}
+
+	rm.Lock()
+	defer rm.Unlock()
+
+	failed := 0
+	if rec.ExitStatus != 0 || rec.Error != "" {
+		failed = 1
+	}
+	rm.counts.ChangeCommands[rec.State][failed]++
+
+	if rec.Interrupted {
+		rm.counts.ChangeTimeoutsInt++
+	}
+
+	if rec.Killed {
+		rm.counts.ChangeTimeoutsKill++
+	}
+
+	rm.counts.ChangeDurationCount++
+	rm.counts.ChangeDurationSum += rec.Duration
+}
+
+/* account for the time a run waited to start, safe to call on nil */
+func (rm *RuleMetrics) observeSchedulingDelay(d time.Duration) {
+	if rm == nil {
+		return
+	}
+
+	rm.Lock()
+	defer rm.Unlock()
+
+	rm.counts.SchedulingDelayCount++
+	rm.counts.SchedulingDelaySum += d
+	if d > rm.counts.SchedulingDelayMax {
+		rm.counts.SchedulingDelayMax = d
+	}
+}
+
+/* account for the latency of a run, measured from when it started, safe to
+ * call on nil.  Runs that overshoot the expected interval have the runs they
+ * crowded out back-filled in the corrected histogram.  That already accounts
+ * for the runs that started late, so it isn't measured from when they were
+ * scheduled as well.
+ */
+func (rm *RuleMetrics) observeLatency(actual time.Duration, expected time.Duration) {
+	if rm == nil {
+		return
+	}
+
+	rm.Lock()
+	defer rm.Unlock()
+
+	rm.latency.Record(actual)
+	rm.latencyCorrected.RecordCorrected(actual, expected)
+}
+
+/* uncorrected and corrected latency percentiles, safe to call on nil */
+func (rm *RuleMetrics) latencies() (LatencyPercentiles, LatencyPercentiles) {
+	if rm == nil {
+		return LatencyPercentiles{}, LatencyPercentiles{}
+	}
+
+	rm.Lock()
+	defer rm.Unlock()
+
+	return rm.latency.Percentiles(), rm.latencyCorrected.Percentiles()
+}
+
+func escapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+/* write every rule's metrics in the prometheus text exposition format */
+func (m *Metrics) Expose(buf io.Writer) {
+	m.Lock()
+	names := make([]string, 0, len(m.rules))
+	for name := range m.rules {
+		names = append(names, name)
+	}
+
+	rules := make([]ruleCounts, 0, len(names))
+	latencies := make([][2]LatencyPercentiles, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		rm := m.rules[name]
+
+		rm.Lock()
+		tmp := rm.counts
+		tmp.DurationBuckets = append([]uint64(nil), rm.counts.DurationBuckets...)
+		rm.Unlock()
+
+		rules = append(rules, tmp)
+
+		uncorrected, corrected := rm.latencies()
+		latencies = append(latencies, [2]LatencyPercentiles{uncorrected, corrected})
+	}
+	m.Unlock()
+
+	labels := func(rm ruleCounts) string {
+		return fmt.Sprintf(`rule="%s",group="%s"`, escapeLabel(rm.Name), escapeLabel(rm.GroupName))
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_runs_total Number of completed test runs.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_runs_total counter\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_runs_total{%s} %d\n", labels(rm), rm.Runs)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_failures_total Number of test runs with a failed result.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_failures_total counter\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_failures_total{%s} %d\n", labels(rm), rm.Failures)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_warnings_total Number of test runs with a warning result.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_warnings_total counter\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_warnings_total{%s} %d\n", labels(rm), rm.Warnings)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_timeouts_total Number of test runs that exceeded a timeout, by the signal sent.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_timeouts_total counter\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_timeouts_total{%s,signal=\"interrupt\"} %d\n", labels(rm), rm.TimeoutsInt)
+		fmt.Fprintf(buf, "hfm_rule_timeouts_total{%s,signal=\"kill\"} %d\n", labels(rm), rm.TimeoutsKill)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_state_changes_total Number of state changes, by the new state.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_state_changes_total counter\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_state_changes_total{%s,state=\"success\"} %d\n", labels(rm), rm.ChangesSuccess)
+		fmt.Fprintf(buf, "hfm_rule_state_changes_total{%s,state=\"fail\"} %d\n", labels(rm), rm.ChangesFail)
+		fmt.Fprintf(buf, "hfm_rule_state_changes_total{%s,state=\"warning\"} %d\n", labels(rm), rm.ChangesWarning)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_state Current state of the rule (0 unknown, 1 success, 2 fail, 3 warning).\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_state gauge\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_state{%s} %d\n", labels(rm), rm.State)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_exec_duration_seconds Time taken by test runs.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_exec_duration_seconds histogram\n")
+	for _, rm := range rules {
+		for i, le := range execDurationBuckets {
+			fmt.Fprintf(buf, "hfm_rule_exec_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels(rm), le, rm.DurationBuckets[i])
+		}
+		fmt.Fprintf(buf, "hfm_rule_exec_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(rm), rm.DurationCount)
+		fmt.Fprintf(buf, "hfm_rule_exec_duration_seconds_sum{%s} %g\n", labels(rm), rm.DurationSum.Seconds())
+		fmt.Fprintf(buf, "hfm_rule_exec_duration_seconds_count{%s} %d\n", labels(rm), rm.DurationCount)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_scheduling_delay_seconds Time test runs waited for max_concurrent_tests to allow them to start.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_scheduling_delay_seconds summary\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_scheduling_delay_seconds_sum{%s} %g\n", labels(rm), rm.SchedulingDelaySum.Seconds())
+		fmt.Fprintf(buf, "hfm_rule_scheduling_delay_seconds_count{%s} %d\n", labels(rm), rm.SchedulingDelayCount)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_scheduling_delay_max_seconds Longest time a test run waited to start.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_scheduling_delay_max_seconds gauge\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_scheduling_delay_max_seconds{%s} %g\n", labels(rm), rm.SchedulingDelayMax.Seconds())
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_latency_seconds Latency of test runs, corrected for coordinated omission or not.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_latency_seconds summary\n")
+	for i, rm := range rules {
+		for j, corrected := range []string{"false", "true"} {
+			p := latencies[i][j]
+			l := fmt.Sprintf("%s,corrected=\"%s\"", labels(rm), corrected)
+
+			fmt.Fprintf(buf, "hfm_rule_latency_seconds{%s,quantile=\"0.5\"} %g\n", l, p.P50.Seconds())
+			fmt.Fprintf(buf, "hfm_rule_latency_seconds{%s,quantile=\"0.9\"} %g\n", l, p.P90.Seconds())
+			fmt.Fprintf(buf, "hfm_rule_latency_seconds{%s,quantile=\"0.99\"} %g\n", l, p.P99.Seconds())
+			fmt.Fprintf(buf, "hfm_rule_latency_seconds{%s,quantile=\"0.999\"} %g\n", l, p.P999.Seconds())
+			fmt.Fprintf(buf, "hfm_rule_latency_seconds_sum{%s} %g\n", l, p.Sum.Seconds())
+			fmt.Fprintf(buf, "hfm_rule_latency_seconds_count{%s} %d\n", l, p.Count)
+		}
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_latency_max_seconds Largest latency of test runs, corrected for coordinated omission or not.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_latency_max_seconds gauge\n")
+	for i, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_latency_max_seconds{%s,corrected=\"false\"} %g\n", labels(rm), latencies[i][0].Max.Seconds())
+		fmt.Fprintf(buf, "hfm_rule_latency_max_seconds{%s,corrected=\"true\"} %g\n", labels(rm), latencies[i][1].Max.Seconds())
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_cert_expiry_days Days until the certificate last seen by a tls test expires.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_cert_expiry_days gauge\n")
+	for _, rm := range rules {
+		if rm.CertSeen {
+			fmt.Fprintf(buf, "hfm_rule_cert_expiry_days{%s} %g\n", labels(rm), rm.CertDaysToExpiry)
+		}
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_change_commands_total Number of completed change commands, by the state they were run for, and result.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_change_commands_total counter\n")
+	for _, rm := range rules {
+		for _, state := range []RuleStateType{RuleStateSuccess, RuleStateFail, RuleStateWarning} {
+			fmt.Fprintf(buf, "hfm_rule_change_commands_total{%s,state=\"%s\",result=\"success\"} %d\n", labels(rm), state.Name(), rm.ChangeCommands[state][0])
+			fmt.Fprintf(buf, "hfm_rule_change_commands_total{%s,state=\"%s\",result=\"fail\"} %d\n", labels(rm), state.Name(), rm.ChangeCommands[state][1])
+		}
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_change_timeouts_total Number of change commands that exceeded a timeout, by the signal sent.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_change_timeouts_total counter\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_change_timeouts_total{%s,signal=\"interrupt\"} %d\n", labels(rm), rm.ChangeTimeoutsInt)
+		fmt.Fprintf(buf, "hfm_rule_change_timeouts_total{%s,signal=\"kill\"} %d\n", labels(rm), rm.ChangeTimeoutsKill)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_change_duration_seconds Time taken by change commands.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_change_duration_seconds summary\n")
+	for _, rm := range rules {
+		fmt.Fprintf(buf, "hfm_rule_change_duration_seconds_sum{%s} %g\n", labels(rm), rm.ChangeDurationSum.Seconds())
+		fmt.Fprintf(buf, "hfm_rule_change_duration_seconds_count{%s} %d\n", labels(rm), rm.ChangeDurationCount)
+	}
+
+	fmt.Fprintf(buf, "# HELP hfm_rule_test_metric Values last reported by a coprocess test, by name.\n")
+	fmt.Fprintf(buf, "# TYPE hfm_rule_test_metric gauge\n")
+	for _, rm := range rules {
+		names := make([]string, 0, len(rm.TestMetrics))
+		for name := range rm.TestMetrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintf(buf, "hfm_rule_test_metric{%s,name=\"%s\"} %g\n", labels(rm), escapeLabel(name), rm.TestMetrics[name])
+		}
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	m.Expose(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+/* serve the metrics over http on addr, at /metrics */
+func (m *Metrics) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Error("Metrics listener on %v failed: %v", addr, err)
+		}
+	}()
+
+	log.Info("Serving metrics on %v.", addr)
+
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "bytes"
+import "io/ioutil"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "time"
+
+func TestMetricsDriverRuns(t *testing.T) {
+	var c Configuration
+	var buf bytes.Buffer
+
+	c.SetConfiguration(`g1 { r1 { runs=2; test="false" } }`)
+
+	m := NewMetrics()
+	ruleDone := make(chan *RuleDriver)
+
+	driver := NewRuleDriver(*c.Rules["g1/r1"], ruleDone, 0)
+	driver.metrics = m.rule("g1/r1", "g1")
+	go driver.Run()
+	<-ruleDone
+
+	m.Expose(&buf)
+	out := buf.String()
+
+	if u, c := driver.Snapshot().Latency, driver.Snapshot().LatencyCorrected; u.Count != 2 || c.Count < 2 {
+		t.Errorf("Expected latency for 2 runs, got: %+v, corrected: %+v", u, c)
+	}
+
+	for _, e := range []string{
+		`hfm_rule_runs_total{rule="g1/r1",group="g1"} 2`,
+		`hfm_rule_failures_total{rule="g1/r1",group="g1"} 2`,
+		`hfm_rule_warnings_total{rule="g1/r1",group="g1"} 0`,
+		`hfm_rule_state_changes_total{rule="g1/r1",group="g1",state="fail"} 1`,
+		`hfm_rule_state{rule="g1/r1",group="g1"} 2`,
+		`hfm_rule_exec_duration_seconds_count{rule="g1/r1",group="g1"} 2`,
+		`hfm_rule_latency_seconds_count{rule="g1/r1",group="g1",corrected="false"} 2`,
+	} {
+		if !strings.Contains(out, e+"\n") {
+			t.Errorf("Expected metrics to contain '%s', got:\n%s", e, out)
+		}
+	}
+}
+
+func TestMetricsUndetermined(t *testing.T) {
+	var c Configuration
+	var buf bytes.Buffer
+
+	c.SetConfiguration(`g1 { r1 { runs=1; timeout_kill=0.05; timeout_state="unknown"; test="sleep"; test_arguments="5" } }`)
+
+	m := NewMetrics()
+	ruleDone := make(chan *RuleDriver)
+
+	driver := NewRuleDriver(*c.Rules["g1/r1"], ruleDone, 0)
+	driver.metrics = m.rule("g1/r1", "g1")
+	go driver.Run()
+	<-ruleDone
+
+	m.Expose(&buf)
+	out := buf.String()
+
+	for _, e := range []string{
+		`hfm_rule_runs_total{rule="g1/r1",group="g1"} 1`,
+		`hfm_rule_failures_total{rule="g1/r1",group="g1"} 0`,
+		`hfm_rule_timeouts_total{rule="g1/r1",group="g1",signal="kill"} 1`,
+		`hfm_rule_state{rule="g1/r1",group="g1"} 0`,
+		`hfm_rule_exec_duration_seconds_count{rule="g1/r1",group="g1"} 1`,
+	} {
+		if !strings.Contains(out, e+"\n") {
+			t.Errorf("Expected metrics to contain '%s', got:\n%s", e, out)
+		}
+	}
+}
+
+func TestMetricsHTTP(t *testing.T) {
+	m := NewMetrics()
+	m.rule(`odd"name`, "g1")
+
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Could not fetch metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `hfm_rule_runs_total{rule="odd\"name",group="g1"} 0`) {
+		t.Errorf("Unexpected metrics response:\n%s", body)
+	}
+}
+
+func TestMetricsLatencyCorrected(t *testing.T) {
+	m := NewMetrics()
+	rm := m.rule("r1", "")
+
+	// a 350ms run, expected every 100ms, crowded out 2 runs
+	rm.observeLatency(350*time.Millisecond, 100*time.Millisecond)
+
+	u, c := rm.latencies()
+	if u.Count != 1 || c.Count != 3 || c.Max != u.Max {
+		t.Errorf("Expected 1 latency, and 3 corrected from the same start, got: %+v, corrected: %+v", u, c)
+	}
+}
@@ -0,0 +1,417 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* definitions */
+
+/* A test run in the driver's goroutine, rather than as a process.  A nil
+ * error is a success.  The deadline is zero when the rule has no timeouts,
+ * ctx is done at the deadline, nativeDefaultTimeout without one, or when the
+ * driver is asked to stop.
+ */
+type nativeTest func(ctx context.Context, rd *RuleDriver, deadline time.Time) error
+
+/* the test types that don't run a process */
+var nativeTests = map[RuleTestType]nativeTest{
+	RuleTestTCP:  runTCPTest,
+	RuleTestHTTP: runHTTPTest,
+	RuleTestDNS:  runDNSTest,
+	RuleTestTLS:  runTLSTest,
+
+	RuleTestAggregate: runAggregateTest,
+}
+
+/* returned by a native test that can't tell the result yet, the run doesn't
+ * count towards the rule's state
+ */
+var errUndetermined = errors.New("undetermined")
+
+/* how much of a response we'll read looking for what's expected */
+const nativeTestMaxRead = 64 * 1024
+
+/* how long a native test may take when the rule has no timeouts */
+const nativeDefaultTimeout = 30 * time.Second
+
+/* meat */
+
+/* The deadline for a native test, from the earliest of timeout_int and
+ * timeout_kill.  Native tests can't be signalled, so the deadline is the only
+ * way to stop them.
+ */
+func (rd *RuleDriver) nativeDeadline() (time.Time, bool) {
+	timeout := rd.Rule.TimeoutInt
+	killed := false
+
+	if rd.Rule.TimeoutKill > 0 && (timeout == 0 || rd.Rule.TimeoutKill < timeout) {
+		timeout = rd.Rule.TimeoutKill
+		killed = true
+	}
+
+	if timeout == 0 {
+		return time.Time{}, false
+	}
+
+	return rd.start.Add(timeout), killed
+}
+
+/* The context a native test runs in, done at the deadline, or when the
+ * driver is asked to stop.
+ */
+func (rd *RuleDriver) nativeContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		deadline = rd.start.Add(nativeDefaultTimeout)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+
+	go func() {
+		select {
+		case <-rd.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+/* close conn once ctx is done, so blocked reads and writes return, until the
+ * returned func is called
+ */
+func closeWhenDone(ctx context.Context, conn net.Conn) func() {
+	finished := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	return func() { close(finished) }
+}
+
+/* run a native test, and record its result as if it were a process that
+ * exited 0 on success, or 1 on failure, false if it was stopped by the driver
+ * being asked to stop
+ */
+func (rd *RuleDriver) runNative(test nativeTest) bool {
+	deadline, killed := rd.nativeDeadline()
+
+	ctx, cancel := rd.nativeContext(deadline)
+	defer cancel()
+
+	err := test(ctx, rd, deadline)
+
+	/* we stopped the test ourselves, it says nothing about the rule */
+	select {
+	case <-rd.quit:
+		if err != nil {
+			log.Info("'%s' run %v stopped by shutdown, not updating state", rd.Rule.Name, rd.GetRunUid())
+			return false
+		}
+	default:
+	}
+
+	if err == nil {
+		return true
+	} else if err == errUndetermined {
+		rd.Last.undetermined = true
+		return true
+	}
+
+	log.Error("'%s' run %s completed with error: %v", rd.Rule.Name, rd.GetRunUid(), err)
+
+	rd.Last.Error = err
+	rd.Last.ExitStatus = 1
+
+	/* account for the deadline as the timeout it came from */
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		if killed {
+			rd.Last.Killed = true
+		} else {
+			rd.Last.Interrupted = true
+		}
+	}
+
+	return true
+}
+
+/* connect to Address, optionally send Send, and wait to see Expect */
+func runTCPTest(ctx context.Context, rd *RuleDriver, deadline time.Time) error {
+	d := net.Dialer{Timeout: rd.Rule.ConnectTimeout}
+
+	conn, err := d.DialContext(ctx, "tcp", rd.Rule.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeWhenDone(ctx, conn)()
+
+	/* without a deadline, connect_timeout bounds the exchange too */
+	if deadline.IsZero() && rd.Rule.ConnectTimeout > 0 {
+		deadline = time.Now().Add(rd.Rule.ConnectTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	if rd.Rule.Send != "" {
+		if _, err := conn.Write([]byte(rd.Rule.Send)); err != nil {
+			return err
+		}
+	}
+
+	if rd.Rule.Expect == "" {
+		return nil
+	}
+
+	expect := []byte(rd.Rule.Expect)
+	buf := make([]byte, 0, 512)
+	tmp := make([]byte, 512)
+
+	for len(buf) < nativeTestMaxRead {
+		n, err := conn.Read(tmp)
+		buf = append(buf, tmp[:n]...)
+
+		if bytes.Contains(buf, expect) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("expected %q, received %q before: %v", rd.Rule.Expect, buf, err)
+		}
+	}
+
+	return fmt.Errorf("expected %q, not found in the first %d bytes received", rd.Rule.Expect, nativeTestMaxRead)
+}
+
+/* the tls settings shared by native tests */
+func (rule *Rule) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: rule.TLSSkipVerify}
+
+	if rule.TLSCA != "" {
+		pem, err := ioutil.ReadFile(rule.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", rule.TLSCA)
+		}
+	}
+
+	if rule.TLSCert != "" {
+		/* the key may be bundled with the certificate */
+		key := rule.TLSKey
+		if key == "" {
+			key = rule.TLSCert
+		}
+
+		cert, err := tls.LoadX509KeyPair(rule.TLSCert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+/* handshake with Address, and check the certificate it presents */
+func runTLSTest(ctx context.Context, rd *RuleDriver, deadline time.Time) error {
+	config, err := rd.Rule.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	config.ServerName = rd.Rule.TLSServerName
+	if config.ServerName == "" {
+		if config.ServerName, _, err = net.SplitHostPort(rd.Rule.Address); err != nil {
+			return err
+		}
+	}
+
+	/* verified after the handshake, so we see the certificate even when it
+	 * doesn't verify
+	 */
+	verify := !config.InsecureSkipVerify
+	config.InsecureSkipVerify = true
+
+	d := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: rd.Rule.ConnectTimeout},
+		Config:    config,
+	}
+
+	nc, err := d.DialContext(ctx, "tcp", rd.Rule.Address)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	conn := nc.(*tls.Conn)
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+
+	leaf := certs[0]
+	remaining := time.Until(leaf.NotAfter)
+
+	rd.Last.CertNotAfter = leaf.NotAfter
+	rd.Last.CertDaysToExpiry = remaining.Hours() / 24
+
+	if verify {
+		opts := x509.VerifyOptions{
+			DNSName:       config.ServerName,
+			Roots:         config.RootCAs,
+			Intermediates: x509.NewCertPool(),
+		}
+
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		if _, err := leaf.Verify(opts); err != nil {
+			return err
+		}
+	}
+
+	if remaining < rd.Rule.TLSExpiryWindow {
+		return fmt.Errorf("certificate expires at %v, within %v", leaf.NotAfter, rd.Rule.TLSExpiryWindow)
+	}
+
+	return nil
+}
+
+/* request URL, and check the response against what's expected */
+func runHTTPTest(ctx context.Context, rd *RuleDriver, deadline time.Time) error {
+	tlsConfig, err := rd.Rule.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	/* a fresh connection every run, so we're testing the whole way there */
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+			DialContext:       (&net.Dialer{Timeout: rd.Rule.ConnectTimeout}).DialContext,
+		},
+	}
+
+	method := rd.Rule.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if rd.Rule.Body != "" {
+		body = strings.NewReader(rd.Rule.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rd.Rule.URL, body)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range rd.Rule.Headers {
+		/* Host isn't sent from the header map */
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	received, err := ioutil.ReadAll(io.LimitReader(resp.Body, nativeTestMaxRead))
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	if !statusExpected(resp.StatusCode, rd.Rule.ExpectStatus) {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	for k, v := range rd.Rule.ExpectHeaders {
+		if got := resp.Header.Get(k); !strings.Contains(got, v) {
+			return fmt.Errorf("expected header %s to contain %q, got %q", k, v, got)
+		}
+	}
+
+	if rd.Rule.BodyContains != "" && !bytes.Contains(received, []byte(rd.Rule.BodyContains)) {
+		return fmt.Errorf("expected body to contain %q, not found in the first %d bytes received", rd.Rule.BodyContains, len(received))
+	}
+
+	if rd.Rule.BodyMatch != nil && !rd.Rule.BodyMatch.Match(received) {
+		return fmt.Errorf("expected body to match %q, not found in the first %d bytes received", rd.Rule.BodyMatch, len(received))
+	}
+
+	if rd.Rule.MaxResponseTime > 0 && elapsed > rd.Rule.MaxResponseTime {
+		return fmt.Errorf("response took %v, longer than %v", elapsed, rd.Rule.MaxResponseTime)
+	}
+
+	return nil
+}
+
+/* any 2xx, unless told otherwise */
+func statusExpected(code int, ranges [][2]int) bool {
+	if len(ranges) == 0 {
+		return code >= 200 && code <= 299
+	}
+
+	return exitCodeIn(code, ranges)
+}
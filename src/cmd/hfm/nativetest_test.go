@@ -0,0 +1,360 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "bufio"
+import "encoding/pem"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "strconv"
+import "testing"
+import "time"
+
+/* answers each line received with the reply, returns the address */
+func startLineServer(t *testing.T, reply string) (net.Listener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				if _, err := r.ReadString('\n'); err == nil {
+					conn.Write([]byte(reply))
+				}
+			}(conn)
+		}
+	}()
+
+	return l, l.Addr().String()
+}
+
+func runNativeRule(t *testing.T, cfg string) *RuleDriver {
+	var c Configuration
+
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	ruleDone := make(chan *RuleDriver)
+
+	driver := RuleDriver{Rule: *c.Rules["default"], Done: ruleDone}
+	go driver.Run()
+
+	return <-ruleDone
+}
+
+func TestNativeTCPConnect(t *testing.T) {
+	l, addr := startLineServer(t, "pong\n")
+	defer l.Close()
+
+	driver := runNativeRule(t, `runs=1; test_type="tcp"; address="`+addr+`"`)
+	if driver.Last.ExitStatus != 0 || driver.Rule.LastState != RuleStateSuccess {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeTCPExpect(t *testing.T) {
+	l, addr := startLineServer(t, "pong\n")
+	defer l.Close()
+
+	driver := runNativeRule(t, `runs=1; test_type="tcp"; address="`+addr+`"; send="ping\n"; expect="pong"`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="tcp"; address="`+addr+`"; send="ping\n"; expect="nope"`)
+	if driver.Last.ExitStatus != 1 || driver.Rule.LastState != RuleStateFail {
+		t.Errorf("Expected failure, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeTCPRefused(t *testing.T) {
+	l, addr := startLineServer(t, "")
+	l.Close()
+
+	driver := runNativeRule(t, `runs=1; test_type="tcp"; address="`+addr+`"; connect_timeout=1s`)
+	if driver.Last.ExitStatus != 1 || driver.Last.Error == nil {
+		t.Errorf("Expected failure, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeExitCodes(t *testing.T) {
+	var c Configuration
+
+	l, addr := startLineServer(t, "")
+	l.Close()
+
+	// the exit codes are for processes, a refused connection still fails
+	cfg := `g1 { warning_exit_codes=1; r1 { runs=1; test_type="tcp"; address="` + addr + `" } r2 { runs=1; test_type="tcp"; address="` + addr + `"; success_exit_codes=[0, 1] } }`
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	for _, name := range []string{"g1/r1", "g1/r2"} {
+		ruleDone := make(chan *RuleDriver)
+
+		driver := RuleDriver{Rule: *c.Rules[name], Done: ruleDone}
+		go driver.Run()
+		<-ruleDone
+
+		if driver.Rule.LastState != RuleStateFail {
+			t.Errorf("%s: expected failure, received: %v, %+v\n", name, driver.Rule.LastState, driver.Last)
+		}
+	}
+}
+
+func TestNativeTCPTimeout(t *testing.T) {
+	// never answers, as nothing is sent
+	l, addr := startLineServer(t, "pong\n")
+	defer l.Close()
+
+	driver := runNativeRule(t, `runs=1; test_type="tcp"; address="`+addr+`"; expect="pong"; timeout_kill=50ms`)
+	if driver.Last.ExitStatus != 1 || !driver.Last.Killed {
+		t.Errorf("Expected failure by timeout, received: %+v\n", driver.Last)
+	}
+}
+
+func startHTTPServer(t *testing.T, tls bool) *httptest.Server {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/echo":
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			w.Write(body)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("status: ok " + r.Header.Get("X-Token") + "\n"))
+	})
+
+	if tls {
+		return httptest.NewTLSServer(h)
+	}
+
+	return httptest.NewServer(h)
+}
+
+func TestNativeHTTPStatus(t *testing.T) {
+	s := startHTTPServer(t, false)
+	defer s.Close()
+
+	driver := runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/"`)
+	if driver.Last.ExitStatus != 0 || driver.Rule.LastState != RuleStateSuccess {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/missing"`)
+	if driver.Last.ExitStatus != 1 || driver.Rule.LastState != RuleStateFail {
+		t.Errorf("Expected failure, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/missing"; expect_status=[200, "400-404"]`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeHTTPRequest(t *testing.T) {
+	s := startHTTPServer(t, false)
+	defer s.Close()
+
+	driver := runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/"; headers { X-Token="abc" }; body_contains="ok abc"; body_match="^status: \\w+"; expect_headers { Content-Type="text/plain" }`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/echo"; method="post"; body="hello"; body_contains="hello"; expect_headers { X-Method="POST" }`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/"; body_match="^nope"`)
+	if driver.Last.ExitStatus != 1 {
+		t.Errorf("Expected failure, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/"; expect_headers { Content-Type="text/html" }`)
+	if driver.Last.ExitStatus != 1 {
+		t.Errorf("Expected failure, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeHTTPTimeouts(t *testing.T) {
+	s := startHTTPServer(t, false)
+	defer s.Close()
+
+	driver := runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/slow"; max_response_time=50ms`)
+	if driver.Last.ExitStatus != 1 || driver.Last.Killed || driver.Last.Interrupted {
+		t.Errorf("Expected failure by response time, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/slow"; timeout_int=50ms`)
+	if driver.Last.ExitStatus != 1 || !driver.Last.Interrupted {
+		t.Errorf("Expected failure by timeout, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeHTTPStopWhileStalled(t *testing.T) {
+	var c Configuration
+
+	// accepts the request, and never answers
+	started := make(chan struct{}, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	if e := c.SetConfiguration(`runs=1; test_type="http"; url="` + s.URL + `/"`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	ruleDone := make(chan *RuleDriver)
+
+	driver := NewRuleDriver(*c.Rules["default"], ruleDone, 0)
+	go driver.Run()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Test never reached the server")
+	}
+
+	driver.Stop()
+
+	select {
+	case <-ruleDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Driver didn't stop while the test was stalled")
+	}
+
+	if driver.Rule.LastState != RuleStateUnknown || driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected the stopped run not to count, received: %v, %+v\n", driver.Rule.LastState, driver.Last)
+	}
+}
+
+func TestNativeHTTPS(t *testing.T) {
+	s := startHTTPServer(t, true)
+	defer s.Close()
+
+	driver := runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/"`)
+	if driver.Last.ExitStatus != 1 {
+		t.Errorf("Expected failure for an unknown certificate, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/"; tls_skip_verify=true`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+
+	ca := writeServerCA(t, s)
+	defer os.Remove(ca)
+
+	driver = runNativeRule(t, `runs=1; test_type="http"; url="`+s.URL+`/"; tls_ca="`+ca+`"`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+}
+
+/* the test server's certificate, as a ca bundle */
+func writeServerCA(t *testing.T, s *httptest.Server) string {
+	ca, err := ioutil.TempFile("", "hfm-ca")
+	if err != nil {
+		t.Fatalf("Could not create ca file: %v", err)
+	}
+	defer ca.Close()
+
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+
+	return ca.Name()
+}
+
+func TestNativeTLS(t *testing.T) {
+	s := startHTTPServer(t, true)
+	defer s.Close()
+
+	ca := writeServerCA(t, s)
+	defer os.Remove(ca)
+
+	addr := s.Listener.Addr().String()
+
+	driver := runNativeRule(t, `runs=1; test_type="tls"; address="`+addr+`"`)
+	if driver.Last.ExitStatus != 1 {
+		t.Errorf("Expected failure for an unknown certificate, received: %+v\n", driver.Last)
+	}
+
+	if driver.Last.CertNotAfter != s.Certificate().NotAfter || driver.Last.CertDaysToExpiry < 1 {
+		t.Errorf("Expected expiry to be recorded, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="tls"; address="`+addr+`"; tls_ca="`+ca+`"; tls_expiry_window=30d`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="tls"; address="`+addr+`"; tls_ca="`+ca+`"; tls_server_name="example.com"`)
+	if driver.Last.ExitStatus != 0 {
+		t.Errorf("Expected success, received: %+v\n", driver.Last)
+	}
+
+	driver = runNativeRule(t, `runs=1; test_type="tls"; address="`+addr+`"; tls_ca="`+ca+`"; tls_server_name="example.net"`)
+	if driver.Last.ExitStatus != 1 {
+		t.Errorf("Expected failure for the wrong name, received: %+v\n", driver.Last)
+	}
+}
+
+func TestNativeTLSExpiry(t *testing.T) {
+	s := startHTTPServer(t, true)
+	defer s.Close()
+
+	window := time.Until(s.Certificate().NotAfter) + 24*time.Hour
+
+	driver := runNativeRule(t, `runs=1; test_type="tls"; address="`+s.Listener.Addr().String()+`"; tls_skip_verify=true; tls_expiry_window=`+strconv.Itoa(int(window.Seconds()))+"s")
+	if driver.Last.ExitStatus != 1 || driver.Last.CertNotAfter.IsZero() {
+		t.Errorf("Expected failure for an expiring certificate, received: %+v\n", driver.Last)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* definitions */
+
+/* how much test output is kept by default for matching, without a match
+ * everything is kept, as before
+ */
+const defaultOutputLimit = 64 * 1024
+
+/* A buffer that keeps the first limit bytes written to it, and counts the
+ * rest.  Writes always succeed, so the test isn't upset by the limit.  A
+ * limit of 0 keeps everything.  Only Write is offered to writers, so the
+ * limit can't be sidestepped with ReadFrom.
+ */
+type limitedBuffer struct {
+	buf bytes.Buffer
+
+	limit   int
+	dropped int
+}
+
+/* meat */
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if b.limit > 0 {
+		room := b.limit - b.buf.Len()
+		if room < 0 {
+			room = 0
+		}
+
+		if len(p) > room {
+			b.dropped += len(p) - room
+			p = p[:room]
+		}
+	}
+
+	b.buf.Write(p)
+
+	return n, nil
+}
+
+func (b *limitedBuffer) Len() int       { return b.buf.Len() }
+func (b *limitedBuffer) Bytes() []byte  { return b.buf.Bytes() }
+func (b *limitedBuffer) String() string { return b.buf.String() }
+
+func (b *limitedBuffer) Reset() {
+	b.buf.Reset()
+	b.dropped = 0
+}
+
+/* Decide the result of the run by its output, stdout followed by stderr.
+ * fail_match wins over success_match, and without a match for either, the
+ * run fails if success_match was given, otherwise the exit status decides.
+ */
+func (rd *RuleDriver) matchOutput() {
+	if rd.Rule.SuccessMatch == nil && rd.Rule.FailMatch == nil {
+		return
+	}
+
+	output := make([]byte, 0, rd.out.Len()+rd.err.Len())
+	output = append(append(output, rd.out.Bytes()...), rd.err.Bytes()...)
+
+	for _, m := range []struct {
+		field string
+		re    *regexp.Regexp
+		state RuleStateType
+	}{
+		{"fail_match", rd.Rule.FailMatch, RuleStateFail},
+		{"success_match", rd.Rule.SuccessMatch, RuleStateSuccess},
+	} {
+		if m.re == nil {
+			continue
+		}
+
+		if groups := m.re.FindSubmatch(output); groups != nil {
+			rd.Last.matched = m.state
+			rd.Last.Captures = captures(m.re, groups)
+			rd.Last.Message = fmt.Sprintf("output matched %s: %q", m.field, groups[0])
+
+			return
+		}
+	}
+
+	if rd.Rule.SuccessMatch != nil {
+		rd.Last.matched = RuleStateFail
+		rd.Last.Message = fmt.Sprintf("output didn't match success_match, in the %d bytes kept", len(output))
+	}
+}
+
+/* The groups matched by re, by number, and name where they have one.  They
+ * end up in the environment of change commands, which can't hold a NUL, so
+ * any are dropped.
+ */
+func captures(re *regexp.Regexp, groups [][]byte) map[string]string {
+	names := re.SubexpNames()
+	c := make(map[string]string, len(groups))
+
+	for i, group := range groups {
+		value := strings.Replace(string(group), "\x00", "", -1)
+		c[strconv.Itoa(i)] = value
+
+		if names[i] != "" {
+			c[names[i]] = value
+		}
+	}
+
+	return c
+}
+
+/* the groups matched in the output, as given to change commands */
+func (rd *RuleDriver) captureEnv() []string {
+	keys := make([]string, 0, len(rd.Last.Captures))
+	for k := range rd.Last.Captures {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, 0, len(keys))
+	for _, k := range keys {
+		env = append(env, "HFM_MATCH_"+strings.ToUpper(k)+"="+rd.Last.Captures[k])
+	}
+
+	return env
+}
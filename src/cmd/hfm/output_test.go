@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "io/ioutil"
+import "os"
+import "reflect"
+import "regexp"
+import "testing"
+
+func TestLimitedBuffer(t *testing.T) {
+	b := limitedBuffer{limit: 4}
+
+	for _, s := range []string{"ab", "cdef", "gh"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Errorf("Expected writes to succeed over the limit, got %d, %v", n, err)
+		}
+	}
+
+	if b.String() != "abcd" || b.dropped != 4 {
+		t.Errorf("Expected 'abcd' kept, and 4 bytes dropped, got '%s', and %d", b.String(), b.dropped)
+	}
+
+	b.Reset()
+	b.limit = 0
+	b.Write([]byte("abcdefgh"))
+	if b.String() != "abcdefgh" || b.dropped != 0 {
+		t.Errorf("Expected everything kept without a limit, got '%s'", b.String())
+	}
+}
+
+func TestDriverOutputMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logFile := dir + "/log"
+	script := `echo $HFM_NEW_STATE $HFM_MATCH_REASON >> ` + logFile
+
+	tests := []struct {
+		output string
+		state  RuleStateType
+	}{
+		{"status: OK", RuleStateSuccess},
+		{"status: DEGRADED (disk 91%)", RuleStateFail},
+		{"something else entirely", RuleStateFail},
+		// past output_limit
+		{"status: OK, and then, later, DEGRADED (fan)", RuleStateSuccess},
+	}
+
+	for _, test := range tests {
+		var c Configuration
+
+		cfg := `r1 { runs=1; output_limit=30; test="echo"; test_arguments="` + test.output + `"; success_match="^status: OK"; fail_match="DEGRADED [(](?P<reason>[^)]*)"; change_fail="/bin/sh"; change_fail_arguments=["-c", "` + script + `"] }`
+		if e := c.SetConfiguration(cfg); e != nil {
+			t.Fatalf("Received error for config: %v", e)
+		}
+
+		ruleDone := make(chan *RuleDriver)
+		driver := NewRuleDriver(*c.Rules["r1"], ruleDone, 0)
+		go driver.Run()
+		<-ruleDone
+
+		if s := driver.Snapshot(); s.Rule.LastState != test.state {
+			t.Errorf("'%s': expected %v, got %v: %s", test.output, test.state, s.Rule.LastState, s.LastMessage)
+		}
+	}
+
+	expected := []string{"fail disk 91%", "fail"}
+	if !waitFor(func() bool { return reflect.DeepEqual(readStateLog(logFile), expected) }) {
+		t.Errorf("Expected change commands given the groups matched %v, got: %v", expected, readStateLog(logFile))
+	}
+
+	var c Configuration
+	if e := c.SetConfiguration(`r1 { test="true"; fail_match="(unclosed" }`); e == nil {
+		t.Errorf("Expected error for an invalid regular expression")
+	}
+}
+
+func TestCaptureEnv(t *testing.T) {
+	re := regexp.MustCompile(`DEGRADED (?P<reason>.*)`)
+
+	driver := RuleDriver{}
+	driver.Last.Captures = captures(re, re.FindSubmatch([]byte("DEGRADED fan\x00 2")))
+
+	expected := []string{"HFM_MATCH_0=DEGRADED fan 2", "HFM_MATCH_1=fan 2", "HFM_MATCH_REASON=fan 2"}
+	if env := driver.captureEnv(); !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, without the NUL, got: %v", expected, env)
+	}
+}
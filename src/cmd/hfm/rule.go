@@ -27,10 +27,20 @@
  */
 
 //go:generate stringer -type=RuleStatusType -type=RuleStateType rule.go
+//go:generate stringer -type=RuleTestType rule.go
+//go:generate stringer -type=RuleTestModeType rule.go
+//go:generate stringer -type=RuleDependsModeType rule.go
+//go:generate stringer -type=RuleDependsRecoveryType rule.go
+//go:generate stringer -type=RuleAggregateType rule.go
+//go:generate stringer -type=RuleTimeoutStateType rule.go
 
 package main
 
-import "time"
+import (
+	"regexp"
+	"strings"
+	"time"
+)
 
 /* definitions */
 
@@ -40,6 +50,7 @@ const (
 	RuleStateUnknown RuleStateType = iota
 	RuleStateSuccess
 	RuleStateFail
+	RuleStateWarning
 )
 
 type RuleStatusType int
@@ -54,6 +65,235 @@ const (
 	RuleStatusAlwaysSuccess
 )
 
+type RuleTestType int
+
+const (
+	/* run Test as a process */
+	RuleTestExec RuleTestType = iota
+	/* connect to Address natively */
+	RuleTestTCP
+	/* make a request to URL natively */
+	RuleTestHTTP
+	/* query DNSServer natively */
+	RuleTestDNS
+	/* handshake with Address natively */
+	RuleTestTLS
+	/* derive the state from other rules' */
+	RuleTestAggregate
+)
+
+type RuleTestModeType int
+
+const (
+	/* start Test for each run */
+	RuleTestModeExec RuleTestModeType = iota
+	/* start Test once, and ask it for the result of each run */
+	RuleTestModeCoprocess
+)
+
+type RuleAggregateType int
+
+const (
+	/* fail once AggregateFailCount of AggregateRules are failed */
+	RuleAggregateKOfN RuleAggregateType = iota
+	/* succeed while any of AggregateRules are successful */
+	RuleAggregateAnySuccess
+	/* succeed while AggregateExpression is true */
+	RuleAggregateExpression
+)
+
+type RuleDependsModeType int
+
+const (
+	/* keep testing while a dependency is failed, but don't run change
+	 * commands
+	 */
+	RuleDependsSuppress RuleDependsModeType = iota
+	/* skip scheduled runs while a dependency is failed */
+	RuleDependsPause
+)
+
+type RuleDependsRecoveryType int
+
+const (
+	/* once dependencies recover, run the change command for the state if
+	 * it isn't the one last run for
+	 */
+	RuleRecoveryReconcile RuleDependsRecoveryType = iota
+	/* once dependencies recover, run the change command for the state */
+	RuleRecoveryAlways
+	/* wait for the next state change */
+	RuleRecoveryNone
+)
+
+type RuleTimeoutStateType int
+
+const (
+	/* a run that timed out is judged by how it exited, like any other */
+	RuleTimeoutStateExit RuleTimeoutStateType = iota
+	RuleTimeoutStateFail
+	RuleTimeoutStateWarning
+	/* a run that timed out doesn't change the state */
+	RuleTimeoutStateUnknown
+)
+
+/* map the configuration names of test types to their values */
+func ParseRuleTestType(s string) (RuleTestType, bool) {
+	switch strings.ToLower(s) {
+	case "exec":
+		return RuleTestExec, true
+	case "tcp":
+		return RuleTestTCP, true
+	case "http":
+		return RuleTestHTTP, true
+	case "dns":
+		return RuleTestDNS, true
+	case "tls":
+		return RuleTestTLS, true
+	case "aggregate":
+		return RuleTestAggregate, true
+	}
+
+	return RuleTestExec, false
+}
+
+/* map the configuration names of test modes to their values */
+func ParseRuleTestMode(s string) (RuleTestModeType, bool) {
+	switch strings.ToLower(s) {
+	case "exec":
+		return RuleTestModeExec, true
+	case "coprocess":
+		return RuleTestModeCoprocess, true
+	}
+
+	return RuleTestModeExec, false
+}
+
+/* map the configuration names of aggregates to their values */
+func ParseRuleAggregate(s string) (RuleAggregateType, bool) {
+	switch strings.ToLower(s) {
+	case "k-of-n":
+		return RuleAggregateKOfN, true
+	case "any-success":
+		return RuleAggregateAnySuccess, true
+	case "expression":
+		return RuleAggregateExpression, true
+	}
+
+	return RuleAggregateKOfN, false
+}
+
+/* map the configuration names of timeout states to their values */
+func ParseRuleTimeoutState(s string) (RuleTimeoutStateType, bool) {
+	switch strings.ToLower(s) {
+	case "exit":
+		return RuleTimeoutStateExit, true
+	case "fail":
+		return RuleTimeoutStateFail, true
+	case "warning":
+		return RuleTimeoutStateWarning, true
+	case "unknown":
+		return RuleTimeoutStateUnknown, true
+	}
+
+	return RuleTimeoutStateExit, false
+}
+
+/* the state a timed out run is given, false to judge it by how it exited */
+func (s RuleTimeoutStateType) state() (RuleStateType, bool) {
+	switch s {
+	case RuleTimeoutStateFail:
+		return RuleStateFail, true
+	case RuleTimeoutStateWarning:
+		return RuleStateWarning, true
+	case RuleTimeoutStateUnknown:
+		return RuleStateUnknown, true
+	}
+
+	return RuleStateUnknown, false
+}
+
+/* map the configuration names of dependency modes to their values */
+func ParseRuleDependsMode(s string) (RuleDependsModeType, bool) {
+	switch strings.ToLower(s) {
+	case "suppress":
+		return RuleDependsSuppress, true
+	case "pause":
+		return RuleDependsPause, true
+	}
+
+	return RuleDependsSuppress, false
+}
+
+/* map the configuration names of recovery policies to their values */
+func ParseRuleDependsRecovery(s string) (RuleDependsRecoveryType, bool) {
+	switch strings.ToLower(s) {
+	case "reconcile":
+		return RuleRecoveryReconcile, true
+	case "always":
+		return RuleRecoveryAlways, true
+	case "none":
+		return RuleRecoveryNone, true
+	}
+
+	return RuleRecoveryReconcile, false
+}
+
+/* map the configuration names of statuses to their values */
+func ParseRuleStatus(s string) (RuleStatusType, bool) {
+	switch strings.ToLower(s) {
+	case "enabled":
+		return RuleStatusEnabled, true
+	case "disabled":
+		return RuleStatusDisabled, true
+	case "always-fail":
+		return RuleStatusAlwaysFail, true
+	case "always-success":
+		return RuleStatusAlwaysSuccess, true
+	}
+
+	return RuleStatusUnset, false
+}
+
+/* so the control socket reports names, rather than numbers */
+func (s RuleStatusType) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s RuleStateType) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+/* map the names of states to their values */
+func ParseRuleState(s string) (RuleStateType, bool) {
+	switch strings.ToLower(s) {
+	case "unknown":
+		return RuleStateUnknown, true
+	case "success":
+		return RuleStateSuccess, true
+	case "fail":
+		return RuleStateFail, true
+	case "warning":
+		return RuleStateWarning, true
+	}
+
+	return RuleStateUnknown, false
+}
+
+/* the name of a state, as given to commands */
+func (s RuleStateType) Name() string {
+	switch s {
+	case RuleStateSuccess:
+		return "success"
+	case RuleStateFail:
+		return "fail"
+	case RuleStateWarning:
+		return "warning"
+	}
+
+	return "unknown"
+}
+
 type Rule struct {
 	/* name of the grouping for the rule */
 	GroupName string
@@ -70,9 +310,34 @@ type Rule struct {
 	/* what is the period between scheduled runs on previously failed rules */
 	IntervalFail time.Duration
 
+	/* while failed, stretch the period between runs by the multiplier after
+	 * each failed run, up to the max, starting over from Interval once a
+	 * run succeeds.  0 max for a fixed IntervalFail.
+	 */
+	IntervalFailMax        time.Duration
+	IntervalFailMultiplier float64
+
+	/* what is the period between scheduled runs on rules with a warning */
+	IntervalWarning time.Duration
+
+	/* run at the wall clock times given by a cron, or calendar expression,
+	 * in Timezone, or local time, rather than every Interval
+	 */
+	Schedule string
+	Timezone string
+
 	/* how long do I delay until starting for the first time */
 	StartDelay time.Duration
 
+	/* add up to Jitter, or JitterPercent of the interval, at random to
+	 * StartDelay, and to each run with JitterTicks.  A non-zero JitterSeed
+	 * makes the randomness repeatable.
+	 */
+	Jitter        time.Duration
+	JitterPercent float64
+	JitterTicks   bool
+	JitterSeed    int64
+
 	/* what is the period this task can run for, before killing it */
 	TimeoutInt  time.Duration
 	TimeoutKill time.Duration
@@ -82,11 +347,96 @@ type Rule struct {
 	 */
 	Runs uint16
 
+	/* how many test processes the rule's group may run at once, 0 for no
+	 * limit, only set on groups
+	 */
+	GroupMaxConcurrentTests uint16
+
+	/* how the test is run, as a process, or natively */
+	TestType RuleTestType
+
+	/* exec tests: whether a process is started for each run, or kept
+	 * running as a coprocess
+	 */
+	TestMode RuleTestModeType
+
 	/* command to run to initiate test */
-	/*  hoping to extend to support go-native tests */
 	Test          string
 	TestArguments []string
 
+	/* where native tests connect to, host:port */
+	Address string
+
+	/* how long a native test waits for a connection */
+	ConnectTimeout time.Duration
+
+	/* tcp: sent once connected, and then expected in the response */
+	Send   string
+	Expect string
+
+	/* http: the request to make */
+	URL     string
+	Method  string
+	Headers map[string]string
+	Body    string
+
+	/* http: what the response must look like, status code ranges are
+	 * inclusive, and header values need only be contained
+	 */
+	ExpectStatus    [][2]int
+	ExpectHeaders   map[string]string
+	BodyMatch       *regexp.Regexp
+	BodyContains    string
+	MaxResponseTime time.Duration
+
+	/* exec tests: decide the result by the output of the test, with up to
+	 * OutputLimit bytes of each of stdout, and stderr kept
+	 */
+	SuccessMatch *regexp.Regexp
+	FailMatch    *regexp.Regexp
+	OutputLimit  int
+
+	/* dns: ask DNSServer (host[:port]) over DNSProtocol (udp, or tcp) for
+	 * the DNSType records of DNSName
+	 */
+	DNSServer   string
+	DNSProtocol string
+	DNSName     string
+	DNSType     string
+
+	/* dns: what the response must look like, answers need only be
+	 * contained, unless ExpectAnswersExact
+	 */
+	ExpectRcode        int
+	ExpectAnswers      []string
+	ExpectAnswersExact bool
+	MinAnswers         uint16
+
+	/* native tests using tls: skip verifying the server, verify it against
+	 * the certificates in TLSCA rather than the system's, and present a
+	 * client certificate
+	 */
+	TLSSkipVerify bool
+	TLSCA         string
+	TLSCert       string
+	TLSKey        string
+
+	/* tls: the name to send, and verify the certificate for, rather than
+	 * the host in Address, and how long before the certificate expires to
+	 * start failing
+	 */
+	TLSServerName   string
+	TLSExpiryWindow time.Duration
+
+	/* aggregate: the state is derived from the states of other rules, as
+	 * given by Aggregate.  A rule that hasn't reported is unknown, and while
+	 * the result depends on unknown rules, runs don't change the state.
+	 */
+	Aggregate           RuleAggregateType
+	AggregateRules      []string
+	AggregateFailCount  uint16
+	AggregateExpression string
+
 	/* command to run when the state changes to failed */
 	ChangeFail          string
 	ChangeFailArguments []string
@@ -97,6 +447,68 @@ type Rule struct {
 	ChangeSuccessArguments []string
 	ChangeSuccessDebounce  uint16
 
+	/* command to run when the state changes to warning */
+	ChangeWarning          string
+	ChangeWarningArguments []string
+	ChangeWarningDebounce  uint16
+
+	/* the state each exit status of the test maps to, checked in this
+	 * order.  Statuses in none of them fail, unless only FailExitCodes is
+	 * given, when they succeed.  Without SuccessExitCodes, 0 succeeds.
+	 */
+	SuccessExitCodes [][2]int
+	WarningExitCodes [][2]int
+	UnknownExitCodes [][2]int
+	FailExitCodes    [][2]int
+
+	/* the state of runs that exceeded TimeoutInt, or TimeoutKill */
+	TimeoutState RuleTimeoutStateType
+
+	/* how long change commands may run before being sent SIGINT, and
+	 * SIGKILL
+	 */
+	ChangeTimeoutInt  time.Duration
+	ChangeTimeoutKill time.Duration
+
+	/* run change commands one at a time, rather than as states change,
+	 * coalescing those queued to the latest.  Rules sharing ChangeLock
+	 * also take turns with each other.
+	 */
+	ChangeSerialize bool
+	ChangeLock      string
+
+	/* retry failed change commands, waiting ChangeRetryInterval in between,
+	 * doubled after each retry with ChangeRetryBackoff
+	 */
+	ChangeRetries       uint16
+	ChangeRetryInterval time.Duration
+	ChangeRetryBackoff  bool
+
+	/* when the rule's state was restored from the state file, whether the
+	 * first run runs the change command even if the state hasn't changed
+	 */
+	ChangeOnRestore bool
+
+	/* when change commands are suppressed, as "<start> to <end>", or
+	 * "<schedule> for <duration>", in Timezone
+	 */
+	Maintenance []string
+
+	/* names of rules that this one depends on, while any of them is
+	 * failed, change commands are suppressed, or runs are paused,
+	 * according to DependsMode, and once they all recover, change commands
+	 * are run according to DependsRecovery
+	 */
+	DependsOn       []string
+	DependsMode     RuleDependsModeType
+	DependsRecovery RuleDependsRecoveryType
+
+	/* added to the environment of the test, and change commands, which is
+	 * otherwise hfm's own, unless ClearEnvironment
+	 */
+	Environment      map[string]string
+	ClearEnvironment bool
+
 	/* current state change, debounce status */
 	ChangeDebounce uint16
 
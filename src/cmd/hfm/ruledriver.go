@@ -30,21 +30,224 @@ package main
 
 /* stdlib includes */
 import (
-	"bytes"
 	"fmt"
-	_ "os"
+	"hash/fnv"
+	"math/rand"
+	"os"
 	"os/exec"
-	_ "os/signal"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type ExitRecord struct {
 	ExecDuration time.Duration
+
+	/* how long the run waited for max_concurrent_tests to allow it */
+	SchedulingDelay time.Duration
+
 	Error        error
 	ExitStatus   int
 	stateChanged bool
+	undetermined bool
+
+	/* the result of the run, after any status has been applied */
+	State RuleStateType
+
+	/* whether the timeout_int or timeout_kill signals were sent */
+	Interrupted bool
+	Killed      bool
+
+	/* the signal that terminated the test, 0 if it exited */
+	Signal syscall.Signal
+
+	/* the result decided by success_match, or fail_match, unknown if
+	 * neither did, and the groups matched
+	 */
+	matched  RuleStateType
+	Captures map[string]string
+
+	/* when the run should have started, if it had kept to schedule */
+	ScheduledStart time.Time
+
+	/* tls tests: when the certificate presented expires, and how many days
+	 * that was from the run, zero if none was presented
+	 */
+	CertNotAfter     time.Time
+	CertDaysToExpiry float64
+
+	/* coprocess, and aggregate tests: what was said about the run */
+	Message string
+	Metrics map[string]float64
+}
+
+/* the processes a driver has started, and hasn't yet reaped */
+type childProcesses struct {
+	sync.Mutex
+
+	procs map[*os.Process]struct{}
+
+	/* set once the processes have been signalled on shutdown, their
+	 * results are no longer meaningful
+	 */
+	aborted bool
+
+	/* the last signal sent, passed on to processes that start late */
+	lastSignal os.Signal
+
+	/* outstanding change commands */
+	changes sync.WaitGroup
+}
+
+func newChildProcesses() *childProcesses {
+	return &childProcesses{procs: make(map[*os.Process]struct{})}
+}
+
+func (c *childProcesses) add(p *os.Process) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.procs[p] = struct{}{}
+
+	if c.aborted {
+		p.Signal(c.lastSignal)
+	}
+}
+
+func (c *childProcesses) remove(p *os.Process) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.procs, p)
+}
+
+func (c *childProcesses) isAborted() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.aborted
+}
+
+/* send sig to every process, and mark the set as aborted */
+func (c *childProcesses) signal(sig os.Signal) int {
+	c.Lock()
+	defer c.Unlock()
+
+	c.aborted = true
+	c.lastSignal = sig
+	for p := range c.procs {
+		/* may have exited already, nothing to do about it */
+		p.Signal(sig)
+	}
+
+	return len(c.procs)
+}
+
+/* what the control socket can see of a driver */
+type RuleSnapshot struct {
+	Rule  Rule
+	Count uint64
+
+	/* when Rule.LastState was entered */
+	LastTransition time.Time
+
+	/* the period between runs in effect, after any backing off */
+	Interval time.Duration
+
+	/* the last completed run */
+	LastStart           time.Time
+	LastScheduledStart  time.Time
+	LastExecDuration    time.Duration
+	LastSchedulingDelay time.Duration
+	LastExitStatus      int
+	LastSignal          syscall.Signal
+	LastError           string
+	LastMessage         string
+	LastMetrics         map[string]float64
+
+	/* tls tests: as of the last run that saw a certificate */
+	CertNotAfter     time.Time
+	CertDaysToExpiry float64
+
+	/* latency of every run, as measured from the start of the run, and
+	 * corrected for the runs that slow ones crowded out
+	 */
+	Latency          LatencyPercentiles
+	LatencyCorrected LatencyPercentiles
+
+	/* the last change command to complete, whether the change command for
+	 * the current state hasn't succeeded yet, or has given up
+	 */
+	LastChange    ChangeRecord
+	ChangePending bool
+	ChangeFailed  bool
+
+	/* the failed dependency holding the rule back, if any */
+	Blocked string
+
+	/* when the maintenance window the rule is in ends, zero if not in one */
+	MaintenanceUntil time.Time
+
+	/* administrative changes made at run time */
+	Paused        bool
+	Override      RuleStatusType
+	OverrideUntil time.Time
+}
+
+/* driver state shared with the control loop, everything else belongs to the
+ * driver's goroutine
+ */
+type driverControl struct {
+	sync.Mutex
+
+	/* as of the end of the last run */
+	snapshot RuleSnapshot
+
+	/* when paused, scheduled runs are skipped */
+	paused bool
+
+	/* replaces the rule's status until overrideUntil, or until cleared if
+	 * overrideUntil is zero
+	 */
+	override      RuleStatusType
+	overrideUntil time.Time
+
+	/* request a run outside of the schedule */
+	runNow chan struct{}
+
+	/* written by change commands as they complete */
+	lastChange ChangeRecord
+
+	/* a maintenance window started at run time, and word that it has
+	 * changed
+	 */
+	maintenanceUntil   time.Time
+	maintenanceChanged chan struct{}
+}
+
+func newDriverControl() *driverControl {
+	return &driverControl{runNow: make(chan struct{}, 1), maintenanceChanged: make(chan struct{}, 1)}
+}
+
+/* the rule's state as persisted, and shared by the driver, apart from
+ * driverControl so the state file is never written while holding it
+ */
+type driverPersistence struct {
+	sync.Mutex
+
+	/* once replaced, or removed, the driver no longer writes its state
+	 * where the rule's successor would see it
+	 */
+	detached bool
+
+	/* the rule's state as last restored, or persisted, handed to the
+	 * driver replacing this one
+	 */
+	persisted    PersistedRule
+	hasPersisted bool
 }
 
 type RuleDriver struct {
@@ -56,19 +259,152 @@ type RuleDriver struct {
 
 	// run meta info
 	start time.Time
-	out   bytes.Buffer
-	err   bytes.Buffer
+	out   limitedBuffer
+	err   limitedBuffer
 
 	dt *DelayedTicker
 
 	cmdDone chan error
+
+	// closed to ask the driver to finish up after the current run
+	quit chan struct{}
+
+	// test and change processes still running
+	children *childProcesses
+
+	// run time administration, from the control socket
+	control *driverControl
+
+	// the rule's state, for the state file, and the driver replacing us
+	persistence *driverPersistence
+
+	// counters exposed to prometheus, may be nil
+	metrics *RuleMetrics
+
+	// how many test processes may run at once, may be nil
+	limits *TestLimits
+
+	// the test process kept between runs, in coprocess mode
+	coproc *coprocess
+
+	// change commands in progress, and waiting their turn when serialized
+	changeState *changeState
+
+	// where the rule's state is kept across restarts, may be nil
+	state          *StateFile
+	lastTransition time.Time
+	restored       bool
+
+	// the state of the rules depended on, may be nil, the failed one
+	// holding us back, and whether they have recovered, with the recovery
+	// policy yet to be applied
+	deps        *Dependencies
+	depsChanged <-chan struct{}
+	blocked     string
+	recovering  bool
+
+	// the interval while failed, as stretched by interval_fail_max, 0 when
+	// not stretching
+	failInterval time.Duration
+
+	// where jitter comes from
+	rand *rand.Rand
+
+	// where scheduled runs get the time from, the real clock if nil
+	clock Clock
+
+	// maintenance windows from the configuration, when the one we're in
+	// ends, zero if not in one, the state as it started, and a timer for
+	// when it ends
+	windows          []maintenanceWindow
+	maintenanceUntil time.Time
+	maintenanceState RuleStateType
+	maintenanceTimer *time.Timer
+	maintenanceEnd   <-chan time.Time
+}
+
+func NewRuleDriver(rule Rule, done chan *RuleDriver, appInstance uint64) *RuleDriver {
+	rd := RuleDriver{Rule: rule, Done: done, AppInstance: appInstance}
+	rd.init()
+	rd.publish()
+
+	return &rd
+}
+
+/* set up anything the zero value doesn't provide */
+func (rd *RuleDriver) init() {
+	rd.out.limit = rd.Rule.OutputLimit
+	rd.err.limit = rd.Rule.OutputLimit
+
+	if rd.cmdDone == nil {
+		rd.cmdDone = make(chan error)
+	}
+	if rd.quit == nil {
+		rd.quit = make(chan struct{})
+	}
+	if rd.children == nil {
+		rd.children = newChildProcesses()
+	}
+	if rd.control == nil {
+		rd.control = newDriverControl()
+	}
+	if rd.persistence == nil {
+		rd.persistence = &driverPersistence{}
+	}
+	if rd.changeState == nil {
+		rd.changeState = newChangeState()
+	}
+	if rd.rand == nil {
+		rd.rand = rand.New(rand.NewSource(rd.jitterSeed()))
+	}
+}
+
+/* Rules sharing a seed still get their own jitter, by mixing in the name.
+ * Without one, it's different every time.
+ */
+func (rd *RuleDriver) jitterSeed() int64 {
+	seed := rd.Rule.JitterSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(rd.Rule.Name))
+
+	return seed ^ int64(h.Sum64())
+}
+
+/* a random delay of up to the rule's jitter, for the given interval */
+func (rd *RuleDriver) jitter(interval time.Duration) time.Duration {
+	max := rd.Rule.Jitter
+	if rd.Rule.JitterPercent > 0 {
+		max = time.Duration(float64(interval) * rd.Rule.JitterPercent / 100)
+	}
+
+	if max <= 0 {
+		return 0
+	}
+
+	return time.Duration(rd.rand.Int63n(int64(max)))
 }
 
 func (rd *RuleDriver) resetLast() {
 	rd.Last.ExecDuration = 0
+	rd.Last.SchedulingDelay = 0
 	rd.Last.Error = nil
 	rd.Last.ExitStatus = 0
 	rd.Last.stateChanged = false
+	rd.Last.undetermined = false
+	rd.Last.State = RuleStateUnknown
+	rd.Last.Interrupted = false
+	rd.Last.Killed = false
+	rd.Last.Signal = 0
+	rd.Last.matched = RuleStateUnknown
+	rd.Last.Captures = nil
+	rd.Last.CertNotAfter = time.Time{}
+	rd.Last.CertDaysToExpiry = 0
+	rd.Last.Message = ""
+	rd.Last.Metrics = nil
 }
 
 func (rd *RuleDriver) handleCmdDone(value reflect.Value) {
@@ -81,12 +417,16 @@ func (rd *RuleDriver) handleCmdDone(value reflect.Value) {
 
 		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
 			rd.Last.ExitStatus = ws.ExitStatus()
+			if ws.Signaled() {
+				rd.Last.Signal = ws.Signal()
+			}
 		}
 	}
 }
 
 func (rd *RuleDriver) handleCmdIntTimeout(cmd *exec.Cmd) {
 	log.Info("'%s' run %s interrupt timeout exceeded, issuing interrupt.", rd.Rule.Name, rd.GetRunUid())
+	rd.Last.Interrupted = true
 	if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
 		log.Error("'%s' run %s failed to interrupt test process: %v, disabling further checks", rd.Rule.Name, rd.GetRunUid(), err)
 		rd.Rule.Status = RuleStatusDisabled
@@ -95,6 +435,7 @@ func (rd *RuleDriver) handleCmdIntTimeout(cmd *exec.Cmd) {
 
 func (rd *RuleDriver) handleCmdKillTimeout(cmd *exec.Cmd) {
 	log.Warning("'%s' run %s kill timeout exceeded, issuing kill.", rd.Rule.Name, rd.GetRunUid())
+	rd.Last.Killed = true
 	if err := cmd.Process.Kill(); err != nil {
 		log.Error("'%s' run %s failed to kill test process: %v, disabling further checks", rd.Rule.Name, rd.GetRunUid(), err)
 		rd.Rule.Status = RuleStatusDisabled
@@ -103,87 +444,162 @@ func (rd *RuleDriver) handleCmdKillTimeout(cmd *exec.Cmd) {
 
 /* process any output produced by the command, get buffers ready for next run */
 func (rd *RuleDriver) handleCmdBuffers() {
+	rd.matchOutput()
+
 	if rd.out.Len() > 0 {
 		log.Info("'%s' run %s test produced output: %v", rd.Rule.Name, rd.GetRunUid(), rd.out.String())
 	}
+	if rd.out.dropped > 0 {
+		log.Info("'%s' run %s test produced %d more bytes of output, over output_limit", rd.Rule.Name, rd.GetRunUid(), rd.out.dropped)
+	}
 	rd.out.Reset()
 
 	if rd.err.Len() > 0 {
 		log.Error("'%s' run %s test produced error output: %v", rd.Rule.Name, rd.GetRunUid(), rd.err.String())
 	}
+	if rd.err.dropped > 0 {
+		log.Error("'%s' run %s test produced %d more bytes of error output, over output_limit", rd.Rule.Name, rd.GetRunUid(), rd.err.dropped)
+	}
 	rd.err.Reset()
 }
 
 func (rd *RuleDriver) handleStateChange(newState RuleStateType) {
 	log.Warning("'%s' run %s changed state to: %v", rd.Rule.Name, rd.GetRunUid(), newState)
 
+	env := rd.changeEnv(rd.Rule.LastState, newState)
+
+	if rd.Rule.LastState != newState {
+		rd.lastTransition = time.Now()
+	}
 	rd.Rule.LastState = newState
 	rd.Last.stateChanged = true
 
-	var changeCmd string
-	var args []string
 	var interval time.Duration
 
-	if newState == RuleStateSuccess {
-		changeCmd = rd.Rule.ChangeSuccess
-		args = rd.Rule.ChangeSuccessArguments
+	switch newState {
+	case RuleStateSuccess:
 		interval = rd.Rule.Interval
-	} else {
-		changeCmd = rd.Rule.ChangeFail
-		args = rd.Rule.ChangeFailArguments
+		rd.failInterval = 0
+	case RuleStateWarning:
+		interval = rd.Rule.IntervalWarning
+		rd.failInterval = 0
+	default:
 		interval = rd.Rule.IntervalFail
+		rd.failInterval = interval
 	}
 
 	rd.dt.ChangeRunningInterval(interval)
 	log.Debug("'%s' run %v, scheduling run in %v", rd.Rule.Name, rd.GetRunUid(), interval)
 
-	if changeCmd == "" {
+	rd.shareState()
+
+	if rd.blocked != "" {
+		log.Info("'%s' run %s dependency '%s' is failed, suppressing change command", rd.Rule.Name, rd.GetRunUid(), rd.blocked)
 		return
 	}
 
-	go func(changeCmd string, args []string) {
-		var stdout bytes.Buffer
-		var stderr bytes.Buffer
+	if !rd.maintenanceUntil.IsZero() {
+		log.Info("'%s' run %s in a maintenance window, suppressing change command", rd.Rule.Name, rd.GetRunUid())
+		return
+	}
 
-		/* XXX: may never return, oooooooo */
-		cmd := exec.Command(changeCmd, args...)
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
+	/* this is as good as recovering */
+	rd.recovering = false
 
-		cmd.Run()
+	rd.change(newState, env)
+}
 
-		if stdout.Len() > 0 {
-			log.Info("'%s' run %s change command produced output: %v", rd.Rule.Name, rd.GetRunUid(), stdout.String())
-		}
-		if stderr.Len() > 0 {
-			log.Error("'%s' run %s change command produced error output: %v", rd.Rule.Name, rd.GetRunUid(), stderr.String())
+/* With interval_fail_max, each failed run while failed stretches the interval
+ * by interval_fail_multiplier, up to interval_fail_max.  The first successful
+ * run goes back to interval, even while debouncing.
+ */
+func (rd *RuleDriver) backOff() {
+	if rd.Rule.IntervalFailMax == 0 || rd.Rule.Schedule != "" || rd.Last.stateChanged {
+		return
+	}
+
+	switch {
+	case rd.Rule.LastState == RuleStateWarning:
+		/* keeps to interval_warning */
+		return
+	case rd.Last.State == RuleStateSuccess:
+		rd.failInterval = 0
+	case rd.Rule.LastState == RuleStateFail:
+		if rd.failInterval == 0 {
+			rd.failInterval = rd.Rule.IntervalFail
+		} else {
+			rd.failInterval = time.Duration(float64(rd.failInterval) * rd.Rule.IntervalFailMultiplier)
+			if rd.failInterval > rd.Rule.IntervalFailMax {
+				rd.failInterval = rd.Rule.IntervalFailMax
+			}
 		}
-	}(changeCmd, args)
+	default:
+		/* failing, but still debouncing */
+		return
+	}
+
+	interval := rd.failInterval
+	if interval == 0 {
+		interval = rd.Rule.Interval
+	}
+
+	if interval != rd.dt.Interval() {
+		log.Debug("'%s' run %v, backing off, scheduling run in %v", rd.Rule.Name, rd.GetRunUid(), interval)
+		rd.dt.ChangeRunningInterval(interval)
+	}
+}
+
+/* start the change command for state, if there is one */
+func (rd *RuleDriver) change(state RuleStateType, env []string) {
+	req := rd.newChangeRequest(state, env)
+	rd.changeState.transition(state, req.Command != "")
+
+	if req.Command == "" {
+		return
+	}
+
+	rd.startChange(req)
 }
 
 /* update the state of the rule if required, take action if state or status
  * requires it
  */
 func (rd *RuleDriver) updateRuleState() {
-	newState := RuleStateSuccess
-	switch {
-	case rd.Last.Error != nil, rd.Last.ExitStatus != 0, rd.Rule.Status == RuleStatusAlwaysFail:
-		if rd.Rule.Status != RuleStatusAlwaysSuccess {
-			newState = RuleStateFail
-		}
+	status := rd.effectiveStatus()
+
+	var newState RuleStateType
+	switch status {
+	case RuleStatusAlwaysSuccess:
+		newState = RuleStateSuccess
+	case RuleStatusAlwaysFail:
+		newState = RuleStateFail
+	default:
+		newState = rd.resultState()
 	}
 
+	rd.Last.State = newState
+
+	/* the first run after restoring state only reaches here if asked to */
+	restored := rd.restored
+	rd.restored = false
+
 	/* if the state has changed, or is an Always */
 	switch {
-	case rd.Rule.LastState == RuleStateUnknown, rd.Rule.Status == RuleStatusAlwaysFail, rd.Rule.Status == RuleStatusAlwaysSuccess:
+	case rd.Rule.LastState == RuleStateUnknown, status == RuleStatusAlwaysFail, status == RuleStatusAlwaysSuccess:
+		rd.handleStateChange(newState)
+	case restored && rd.Rule.ChangeOnRestore && rd.Rule.LastState == newState:
+		log.Info("'%s' run %s matches restored state %v, running change command anyway", rd.Rule.Name, rd.GetRunUid(), newState)
 		rd.handleStateChange(newState)
 	case rd.Rule.LastState != newState:
 		var delta int32
 		rd.Rule.ChangeDebounce++
 
-		if newState == RuleStateFail {
+		switch newState {
+		case RuleStateFail:
 			delta = int32(rd.Rule.ChangeFailDebounce) - int32(rd.Rule.ChangeDebounce)
-		} else {
+		case RuleStateWarning:
+			delta = int32(rd.Rule.ChangeWarningDebounce) - int32(rd.Rule.ChangeDebounce)
+		default:
 			delta = int32(rd.Rule.ChangeSuccessDebounce) - int32(rd.Rule.ChangeDebounce)
 		}
 
@@ -198,6 +614,65 @@ func (rd *RuleDriver) updateRuleState() {
 	}
 }
 
+/* the state the result of the run maps to, before any status is applied */
+func (rd *RuleDriver) resultState() RuleStateType {
+	if rd.Last.Interrupted || rd.Last.Killed {
+		if state, ok := rd.Rule.TimeoutState.state(); ok {
+			return state
+		}
+	}
+
+	switch {
+	case rd.Last.Signal != 0:
+		return RuleStateFail
+	case rd.Last.matched != RuleStateUnknown:
+		return rd.Last.matched
+	}
+
+	/* native tests have no exit status of their own, the exit codes are
+	 * for processes
+	 */
+	if _, ok := nativeTests[rd.Rule.TestType]; ok {
+		if rd.Last.Error != nil {
+			return RuleStateFail
+		}
+		return RuleStateSuccess
+	}
+
+	return rd.Rule.exitState(rd.Last.ExitStatus)
+}
+
+/* the state an exit status of the test maps to */
+func (rule *Rule) exitState(code int) RuleStateType {
+	switch {
+	case exitCodeIn(code, rule.SuccessExitCodes):
+		return RuleStateSuccess
+	case exitCodeIn(code, rule.WarningExitCodes):
+		return RuleStateWarning
+	case exitCodeIn(code, rule.UnknownExitCodes):
+		return RuleStateUnknown
+	case exitCodeIn(code, rule.FailExitCodes):
+		return RuleStateFail
+	case rule.SuccessExitCodes != nil:
+		return RuleStateFail
+	case code == 0, rule.FailExitCodes != nil:
+		return RuleStateSuccess
+	}
+
+	return RuleStateFail
+}
+
+/* whether code is in any of the ranges */
+func exitCodeIn(code int, ranges [][2]int) bool {
+	for _, r := range ranges {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (rd *RuleDriver) GetRunUid() string {
 	if rd.AppInstance != 0 {
 		return fmt.Sprintf("%x:%s:%x", rd.AppInstance, rd.Rule.Name, rd.count)
@@ -206,6 +681,68 @@ func (rd *RuleDriver) GetRunUid() string {
 	}
 }
 
+/* The environment of a command started for the rule.  Rule context is
+ * added last, so the rule's environment can't override it.
+ */
+func (rd *RuleDriver) commandEnv(extra ...string) []string {
+	var env []string
+	if !rd.Rule.ClearEnvironment {
+		env = os.Environ()
+	}
+
+	keys := make([]string, 0, len(rd.Rule.Environment))
+	for k := range rd.Rule.Environment {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		env = append(env, k+"="+rd.Rule.Environment[k])
+	}
+
+	env = append(env,
+		"HFM_RULE="+rd.Rule.Name,
+		"HFM_GROUP="+rd.Rule.GroupName,
+		"HFM_RUN_UID="+rd.GetRunUid(),
+		"HFM_RUN_COUNT="+strconv.FormatUint(rd.count, 10),
+		"HFM_CHANGE_DEBOUNCE="+strconv.Itoa(int(rd.Rule.ChangeDebounce)),
+		"HFM_CHANGE_FAIL_DEBOUNCE="+strconv.Itoa(int(rd.Rule.ChangeFailDebounce)),
+		"HFM_CHANGE_SUCCESS_DEBOUNCE="+strconv.Itoa(int(rd.Rule.ChangeSuccessDebounce)),
+		"HFM_CHANGE_WARNING_DEBOUNCE="+strconv.Itoa(int(rd.Rule.ChangeWarningDebounce)),
+	)
+
+	return append(env, extra...)
+}
+
+/* the environment of a change command, with the result that caused it */
+func (rd *RuleDriver) changeEnv(previous RuleStateType, newState RuleStateType) []string {
+	extra := []string{
+		"HFM_PREVIOUS_STATE=" + previous.Name(),
+		"HFM_NEW_STATE=" + newState.Name(),
+		"HFM_EXIT_STATUS=" + strconv.Itoa(rd.Last.ExitStatus),
+		"HFM_EXEC_DURATION_NS=" + strconv.FormatInt(int64(rd.Last.ExecDuration), 10),
+	}
+
+	if rd.Last.Signal != 0 {
+		extra = append(extra, "HFM_SIGNAL="+strconv.Itoa(int(rd.Last.Signal)))
+	}
+
+	extra = append(extra, rd.captureEnv()...)
+
+	if rd.Last.Message != "" {
+		extra = append(extra, "HFM_MESSAGE="+rd.Last.Message)
+	}
+
+	if !rd.Last.CertNotAfter.IsZero() {
+		extra = append(extra,
+			"HFM_CERT_NOT_AFTER="+rd.Last.CertNotAfter.UTC().Format(time.RFC3339),
+			"HFM_CERT_DAYS_TO_EXPIRY="+strconv.FormatFloat(rd.Last.CertDaysToExpiry, 'f', 2, 64),
+		)
+	}
+
+	return rd.commandEnv(extra...)
+}
+
 func (rd *RuleDriver) buildCases() []reflect.SelectCase {
 
 	timeoutInt := rd.Rule.TimeoutInt
@@ -234,32 +771,42 @@ func (rd *RuleDriver) buildCases() []reflect.SelectCase {
 	return cases
 }
 
-func (rd *RuleDriver) realRun() {
-	rd.start = time.Now()
-	rd.count++
-
-	log.Debug("'%s' starting run %v, at %v...", rd.Rule.Name, rd.GetRunUid(), rd.start)
-
-	rd.resetLast()
-
+/* run the test as a process, false if it couldn't be started */
+func (rd *RuleDriver) runExec() bool {
 	// new cmd
 	cmd := exec.Command(rd.Rule.Test, rd.Rule.TestArguments...)
+	cmd.Env = rd.commandEnv("HFM_PREVIOUS_STATE=" + rd.Rule.LastState.Name())
 
 	cmd.Stdout = &rd.out
 	cmd.Stderr = &rd.err
 
+	/* wait our turn, the run starts once we have it */
+	release, ok := rd.limits.acquire(rd.Rule.GroupName, rd.quit)
+	if !ok {
+		log.Debug("'%s' run %v asked to stop while waiting to start", rd.Rule.Name, rd.GetRunUid())
+		return false
+	}
+
+	rd.Last.SchedulingDelay = time.Since(rd.start)
+	rd.metrics.observeSchedulingDelay(rd.Last.SchedulingDelay)
+	rd.start = rd.start.Add(rd.Last.SchedulingDelay)
+
 	cases := rd.buildCases()
 
 	if err := cmd.Start(); err != nil {
+		release()
 		rd.Rule.Status = RuleStatusDisabled
 		log.Error("'%s' %s failed to start, disabling: %v", rd.Rule.Name, rd.GetRunUid(), err)
 
-		rd.Done <- rd
-		return
+		return false
 	}
 
+	rd.children.add(cmd.Process)
 	go func() {
-		rd.cmdDone <- cmd.Wait()
+		err := cmd.Wait()
+		release()
+		rd.children.remove(cmd.Process)
+		rd.cmdDone <- err
 	}()
 
 	/* while we still are expecting events to listen to */
@@ -289,41 +836,410 @@ func (rd *RuleDriver) realRun() {
 			cases = cases[:i]
 		}
 	}
+
+	return true
+}
+
+func (rd *RuleDriver) realRun(scheduled time.Time) {
+	rd.start = time.Now()
+	rd.count++
+
+	/* the interval the schedule expects us to keep */
+	expected := rd.dt.Interval()
+
+	log.Debug("'%s' starting run %v, at %v...", rd.Rule.Name, rd.GetRunUid(), rd.start)
+
+	rd.resetLast()
+	rd.Last.ScheduledStart = scheduled
+
+	started := true
+	if test, ok := nativeTests[rd.Rule.TestType]; ok {
+		started = rd.runNative(test)
+	} else if rd.Rule.TestMode == RuleTestModeCoprocess {
+		started = rd.runCoprocess()
+	} else {
+		started = rd.runExec()
+	}
+
+	if !started {
+		rd.publish()
+		return
+	}
+
 	rd.Last.ExecDuration = time.Since(rd.start)
+	rd.metrics.observeLatency(rd.Last.ExecDuration, expected)
 
 	rd.handleCmdBuffers()
 
-	rd.updateRuleState()
+	/* we interrupted the test ourselves, it says nothing about the rule */
+	if rd.children.isAborted() {
+		log.Info("'%s' run %v aborted by shutdown, not updating state", rd.Rule.Name, rd.GetRunUid())
+		return
+	}
+
+	/* exit statuses, and timeouts may say nothing about the rule */
+	switch rd.effectiveStatus() {
+	case RuleStatusAlwaysFail, RuleStatusAlwaysSuccess:
+	default:
+		if !rd.Last.undetermined && rd.resultState() == RuleStateUnknown {
+			rd.Last.undetermined = true
+			if rd.Last.Interrupted || rd.Last.Killed {
+				rd.Last.Message = "timed out"
+			} else {
+				rd.Last.Message = fmt.Sprintf("exit status %d", rd.Last.ExitStatus)
+			}
+		}
+	}
+
+	if rd.Last.undetermined {
+		log.Debug("'%s' run %v undetermined, not updating state: %s", rd.Rule.Name, rd.GetRunUid(), rd.Last.Message)
+	} else {
+		/* dependencies may have failed, or maintenance started while the
+		 * test ran
+		 */
+		rd.checkDependencies()
+		rd.checkMaintenance()
+
+		rd.updateRuleState()
+	}
+
+	/* undetermined runs, and their timeouts are still counted */
+	rd.metrics.observeRun(rd.Last, rd.Rule.LastState)
+
+	if !rd.Last.undetermined {
+		rd.backOff()
+	}
+
+	rd.persist()
 
 	if rd.Rule.Runs > 0 && rd.count >= uint64(rd.Rule.Runs) {
 		log.Debug("'%s' run %v, runs configured exceeded, disabling", rd.Rule.Name, rd.GetRunUid())
 		rd.Rule.Status = RuleStatusDisabled
 	}
+
+	rd.publish()
 }
 
 func (rd *RuleDriver) Run() {
-	rd.cmdDone = make(chan error)
+	rd.init()
 
 	rd.dt = NewDelayedTicker()
-	defer rd.dt.Stop()
 
-	log.Debug("'%s' first run in %v", rd.Rule.Name, rd.Rule.StartDelay)
-	rd.dt.Start(rd.Rule.StartDelay, rd.Rule.Interval)
+	/* restored rules may already be failed, or warning */
+	interval := rd.Rule.Interval
+	switch rd.Rule.LastState {
+	case RuleStateFail:
+		interval = rd.Rule.IntervalFail
+	case RuleStateWarning:
+		interval = rd.Rule.IntervalWarning
+	}
+
+	if rd.Rule.Schedule != "" {
+		/* already validated with the configuration */
+		if sched, err := rd.Rule.schedule(); err != nil {
+			log.Error("'%s' invalid schedule, running every %v instead: %v", rd.Rule.Name, interval, err)
+		} else {
+			rd.dt.Schedule = sched
+			rd.dt.Clock = rd.clock
+			interval = 0
+		}
+	}
+
+	/* keep rules with the same schedule from all starting at once, for a
+	 * wall clock schedule that means every run
+	 */
+	delay := rd.Rule.StartDelay
+	if rd.Rule.JitterTicks || rd.dt.Schedule != nil {
+		rd.dt.Jitter = rd.jitter
+	} else {
+		delay += rd.jitter(interval)
+	}
+
+	log.Debug("'%s' first run in %v", rd.Rule.Name, delay)
+	rd.dt.Start(delay, interval)
+
+	/* already validated with the configuration */
+	if windows, err := rd.Rule.maintenanceWindows(); err != nil {
+		log.Error("'%s' invalid maintenance windows, ignoring them: %v", rd.Rule.Name, err)
+	} else {
+		rd.windows = windows
+	}
 
-	/*
-		interrupt := make(chan os.Signal, 1)
-		signal.Notify(interrupt, os.Interrupt)
-		signal.Notify(interrupt, syscall.SIGTERM)
-	*/
+	rd.shareState()
+	rd.checkDependencies()
+	rd.checkMaintenance()
 
+events:
 	for rd.Rule.Status != RuleStatusDisabled {
 		log.Debug("'%s' run %v, waiting for next event", rd.Rule.Name, rd.GetRunUid())
 
 		select {
-		case <-rd.dt.C:
-			rd.realRun()
+		case scheduled := <-rd.dt.C:
+			rd.checkDependencies()
+			if rd.isPaused() {
+				log.Debug("'%s' run %v, paused, skipping scheduled run", rd.Rule.Name, rd.GetRunUid())
+				break
+			}
+			if rd.blocked != "" && rd.Rule.DependsMode == RuleDependsPause {
+				log.Debug("'%s' run %v, dependency '%s' is failed, skipping scheduled run", rd.Rule.Name, rd.GetRunUid(), rd.blocked)
+				break
+			}
+			rd.realRun(scheduled)
+		case <-rd.control.runNow:
+			log.Info("'%s' run %v, running on request", rd.Rule.Name, rd.GetRunUid())
+			rd.realRun(time.Now())
+		case <-rd.depsChanged:
+			rd.checkDependencies()
+		case <-rd.maintenanceEnd:
+			rd.checkMaintenance()
+		case <-rd.control.maintenanceChanged:
+			rd.checkMaintenance()
+		case <-rd.quit:
+			log.Debug("'%s' run %v, asked to stop", rd.Rule.Name, rd.GetRunUid())
+			break events
+		}
+
+		if rd.recovering && rd.Rule.Status != RuleStatusDisabled {
+			rd.recoverDependencies()
 		}
 	}
 
+	/* the ticker is stopped on the way out, but change commands may still
+	 * be running, don't report done until they are
+	 */
+	rd.dt.Stop()
+	if rd.maintenanceTimer != nil {
+		rd.maintenanceTimer.Stop()
+	}
+	rd.stopCoprocess()
+	rd.children.changes.Wait()
+
 	rd.Done <- rd
 }
+
+/* Stop sharing the rule's state, in the state file, and with its dependents,
+ * so it can be forgotten, or handed to a new driver, without this one
+ * writing over it.  Returns the state last persisted, if any, for the new
+ * driver to restore.  Safe to call from any goroutine, and once it returns no
+ * more writes will be made.
+ */
+func (rd *RuleDriver) detach() (PersistedRule, bool) {
+	rd.persistence.Lock()
+	defer rd.persistence.Unlock()
+
+	rd.persistence.detached = true
+
+	return rd.persistence.persisted, rd.persistence.hasPersisted
+}
+
+/* Ask the driver to stop scheduling runs.  Any exec run in progress is
+ * allowed to complete, native, and coprocess runs are abandoned, and the
+ * driver will send on Done as usual.  Only valid for
+ * drivers created with NewRuleDriver, and only to be called from the
+ * goroutine that owns the driver.
+ */
+func (rd *RuleDriver) Stop() {
+	select {
+	case <-rd.quit:
+		// already stopping
+	default:
+		close(rd.quit)
+	}
+}
+
+/* Send sig to any test or change processes this driver is waiting on.  Runs
+ * interrupted this way don't update the rule state.  Returns the number of
+ * processes signalled.
+ */
+func (rd *RuleDriver) SignalChildren(sig os.Signal) int {
+	return rd.children.signal(sig)
+}
+
+/* copy the driver's state for the control loop to read */
+func (rd *RuleDriver) publish() {
+	rd.control.Lock()
+	defer rd.control.Unlock()
+
+	rd.control.snapshot.Rule = rd.Rule
+	rd.control.snapshot.Count = rd.count
+	rd.control.snapshot.LastStart = rd.start
+	rd.control.snapshot.LastScheduledStart = rd.Last.ScheduledStart
+	rd.control.snapshot.LastExecDuration = rd.Last.ExecDuration
+	rd.control.snapshot.LastSchedulingDelay = rd.Last.SchedulingDelay
+	rd.control.snapshot.LastExitStatus = rd.Last.ExitStatus
+	rd.control.snapshot.LastSignal = rd.Last.Signal
+	rd.control.snapshot.LastTransition = rd.lastTransition
+	rd.control.snapshot.Blocked = rd.blocked
+	rd.control.snapshot.MaintenanceUntil = rd.maintenanceUntil
+	if rd.dt != nil {
+		rd.control.snapshot.Interval = rd.dt.Interval()
+	}
+	rd.control.snapshot.LastMessage = rd.Last.Message
+	rd.control.snapshot.LastMetrics = rd.Last.Metrics
+
+	if !rd.Last.CertNotAfter.IsZero() {
+		rd.control.snapshot.CertNotAfter = rd.Last.CertNotAfter
+		rd.control.snapshot.CertDaysToExpiry = rd.Last.CertDaysToExpiry
+	}
+
+	rd.control.snapshot.LastError = ""
+	if rd.Last.Error != nil {
+		rd.control.snapshot.LastError = rd.Last.Error.Error()
+	}
+}
+
+/* Pick up where the rule left off, as recorded in sf, and keep recording it
+ * there.  Only to be called before Run.
+ */
+func (rd *RuleDriver) restoreState(sf *StateFile) {
+	rd.state = sf
+
+	if pr, ok := sf.get(rd.Rule.Name); ok {
+		rd.restore(pr)
+	} else {
+		rd.init()
+	}
+}
+
+/* Pick up where the rule left off, as persisted by this, or a previous
+ * driver.  Only to be called before Run.
+ */
+func (rd *RuleDriver) restore(pr PersistedRule) {
+	rd.init()
+
+	state, ok := ParseRuleState(pr.State)
+	if !ok {
+		log.Warning("'%s' unrecognized state '%s' in state file, ignoring", rd.Rule.Name, pr.State)
+		return
+	}
+
+	rd.Rule.LastState = state
+	rd.Rule.ChangeDebounce = pr.ChangeDebounce
+	rd.lastTransition = pr.LastTransition
+	rd.count = pr.Count
+	rd.restored = true
+	rd.changeState.target = state
+
+	rd.persistence.Lock()
+	rd.persistence.persisted, rd.persistence.hasPersisted = pr, true
+	rd.persistence.Unlock()
+
+	log.Info("'%s' restored state %v, last changed at %v, after %d runs", rd.Rule.Name, state, pr.LastTransition, pr.Count)
+
+	rd.publish()
+}
+
+/* Record the rule's state for the driver replacing this one, and in the
+ * state file, if there is one.  The file is only written when the state, or
+ * debouncing has changed, a new run count alone waits for the next write,
+ * or for the state file to be flushed at shutdown.
+ */
+func (rd *RuleDriver) persist() {
+	rd.persistence.Lock()
+	defer rd.persistence.Unlock()
+
+	if rd.persistence.detached {
+		return
+	}
+
+	pr := PersistedRule{
+		State:          rd.Rule.LastState.Name(),
+		ChangeDebounce: rd.Rule.ChangeDebounce,
+		LastTransition: rd.lastTransition,
+		Count:          rd.count,
+	}
+
+	last := rd.persistence.persisted
+	last.Count = pr.Count
+	changed := !rd.persistence.hasPersisted || last != pr
+
+	rd.persistence.persisted, rd.persistence.hasPersisted = pr, true
+
+	if !changed {
+		rd.state.record(rd.Rule.Name, pr)
+		return
+	}
+
+	if err := rd.state.update(rd.Rule.Name, pr); err != nil {
+		log.Error("'%s' run %s could not write state file %v: %v", rd.Rule.Name, rd.GetRunUid(), rd.state.Path, err)
+	}
+}
+
+/* The driver's state as of its last run, safe to call from any goroutine */
+func (rd *RuleDriver) Snapshot() RuleSnapshot {
+	rd.control.Lock()
+	defer rd.control.Unlock()
+
+	s := rd.control.snapshot
+	s.Latency, s.LatencyCorrected = rd.metrics.latencies()
+	s.LastChange = rd.control.lastChange
+	s.ChangePending, s.ChangeFailed = rd.changeState.flags()
+	s.Paused = rd.control.paused
+	s.Override = rd.control.override
+	s.OverrideUntil = rd.control.overrideUntil
+
+	if !s.OverrideUntil.IsZero() && time.Now().After(s.OverrideUntil) {
+		s.Override = RuleStatusUnset
+		s.OverrideUntil = time.Time{}
+	}
+
+	return s
+}
+
+/* Skip (or resume) scheduled runs, safe to call from any goroutine */
+func (rd *RuleDriver) SetPaused(paused bool) {
+	rd.control.Lock()
+	defer rd.control.Unlock()
+
+	rd.control.paused = paused
+}
+
+func (rd *RuleDriver) isPaused() bool {
+	rd.control.Lock()
+	defer rd.control.Unlock()
+
+	return rd.control.paused
+}
+
+/* Replace the rule's status until the given time, or until cleared if until
+ * is zero.  RuleStatusUnset clears the override.  Safe to call from any
+ * goroutine.
+ */
+func (rd *RuleDriver) SetOverride(status RuleStatusType, until time.Time) {
+	rd.control.Lock()
+	defer rd.control.Unlock()
+
+	rd.control.override = status
+	rd.control.overrideUntil = until
+}
+
+/* the rule's status, taking any unexpired override into account */
+func (rd *RuleDriver) effectiveStatus() RuleStatusType {
+	rd.control.Lock()
+	defer rd.control.Unlock()
+
+	if rd.control.override == RuleStatusUnset {
+		return rd.Rule.Status
+	}
+
+	if !rd.control.overrideUntil.IsZero() && time.Now().After(rd.control.overrideUntil) {
+		log.Info("'%s' status override to %v expired", rd.Rule.Name, rd.control.override)
+		rd.control.override = RuleStatusUnset
+		rd.control.overrideUntil = time.Time{}
+
+		return rd.Rule.Status
+	}
+
+	return rd.control.override
+}
+
+/* Run the test as soon as the driver is free, safe to call from any
+ * goroutine
+ */
+func (rd *RuleDriver) RunNow() {
+	select {
+	case rd.control.runNow <- struct{}{}:
+	default:
+		// one is already pending
+	}
+}
@@ -32,6 +32,9 @@ import "testing"
 import "time"
 import "io/ioutil"
 import "os"
+import "reflect"
+import "strings"
+import "syscall"
 
 /* tightly coupled to the the logging interface ! */
 import "github.com/op/go-logging"
@@ -532,3 +535,279 @@ EOD
 	}
 
 }
+
+func TestDriverEnvironment(t *testing.T) {
+	var c Configuration
+
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("HFM_TEST_DAEMON", "1")
+	defer os.Unsetenv("HFM_TEST_DAEMON")
+
+	cfg := `
+g1 {
+	environment { FOO="group"; BAR="group" }
+	clear_environment=true
+	r1 {
+		runs=1
+		environment { FOO="rule"; HFM_RULE="nope" }
+		test="/bin/sh"
+		test_arguments=["-c", "env > ` + dir + `/test; exit 3"]
+		change_fail="/bin/sh"
+		change_fail_arguments=["-c", "env > ` + dir + `/change"]
+	}
+}`
+
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	ruleDone := make(chan *RuleDriver)
+
+	driver := RuleDriver{Rule: *c.Rules["g1/r1"], Done: ruleDone}
+	go driver.Run()
+
+	<-ruleDone
+
+	for file, expected := range map[string][]string{
+		"test": {
+			"FOO=rule", "BAR=group", "HFM_RULE=g1/r1", "HFM_GROUP=g1", "HFM_RUN_UID=g1/r1:1",
+			"HFM_RUN_COUNT=1", "HFM_PREVIOUS_STATE=unknown", "HFM_CHANGE_FAIL_DEBOUNCE=1",
+		},
+		"change": {
+			"FOO=rule", "HFM_RULE=g1/r1", "HFM_PREVIOUS_STATE=unknown", "HFM_NEW_STATE=fail",
+			"HFM_EXIT_STATUS=3", "HFM_EXEC_DURATION_NS=",
+		},
+	} {
+		env, err := ioutil.ReadFile(dir + "/" + file)
+		if err != nil {
+			t.Fatalf("Could not read %s environment: %v", file, err)
+		}
+
+		for _, e := range expected {
+			if !strings.Contains("\n"+string(env), "\n"+e) {
+				t.Errorf("Expected %s environment to contain '%s', got:\n%s", file, e, env)
+			}
+		}
+
+		if strings.Contains(string(env), "HFM_TEST_DAEMON") {
+			t.Errorf("Expected %s environment to be cleared, got:\n%s", file, env)
+		}
+	}
+}
+
+func TestDriverIntervalFailBackoff(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`r1 { test="false"; interval=1s; interval_fail=2s; interval_fail_max=10s; interval_fail_multiplier=1.5 }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	driver := NewRuleDriver(*c.Rules["r1"], nil, 0)
+	driver.dt = NewDelayedTicker()
+	driver.dt.Start(time.Hour, driver.Rule.Interval)
+	defer driver.dt.Stop()
+
+	run := func(result RuleStateType) time.Duration {
+		driver.resetLast()
+		driver.Last.State = result
+		if result == RuleStateFail {
+			driver.Last.ExitStatus = 1
+		}
+		driver.updateRuleState()
+		driver.backOff()
+
+		return driver.dt.Interval()
+	}
+
+	expected := []time.Duration{2 * time.Second, 3 * time.Second, 4500 * time.Millisecond, 6750 * time.Millisecond, 10 * time.Second, 10 * time.Second}
+	for i, interval := range expected {
+		if got := run(RuleStateFail); got != interval {
+			t.Errorf("Expected interval %v after failed run %d, got: %v", interval, i+1, got)
+		}
+	}
+
+	if got := run(RuleStateSuccess); got != time.Second {
+		t.Errorf("Expected interval to reset after a success, got: %v", got)
+	}
+
+	// while debouncing a failure, the interval doesn't change
+	driver.Rule.ChangeFailDebounce = 2
+	if got := run(RuleStateFail); got != time.Second {
+		t.Errorf("Expected interval to hold while debouncing, got: %v", got)
+	}
+	if got := run(RuleStateFail); got != 2*time.Second {
+		t.Errorf("Expected interval_fail once failed, got: %v", got)
+	}
+}
+
+func TestDriverWarning(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`r1 { test="/usr/lib/nagios/plugins/check_load"; warning_exit_codes=1; interval=1s; interval_fail=2s; interval_warning=3s; change_warning_debounce=2 }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	driver := NewRuleDriver(*c.Rules["r1"], nil, 0)
+	driver.dt = NewDelayedTicker()
+	driver.dt.Start(time.Hour, driver.Rule.Interval)
+	defer driver.dt.Stop()
+
+	tests := []struct {
+		exit     int
+		state    RuleStateType
+		interval time.Duration
+	}{
+		{1, RuleStateWarning, 3 * time.Second},
+		{0, RuleStateSuccess, time.Second},
+		// debounced
+		{1, RuleStateSuccess, time.Second},
+		{1, RuleStateWarning, 3 * time.Second},
+		{2, RuleStateFail, 2 * time.Second},
+	}
+
+	for i, test := range tests {
+		driver.resetLast()
+		driver.Last.ExitStatus = test.exit
+		driver.updateRuleState()
+		driver.backOff()
+
+		if driver.Rule.LastState != test.state || driver.dt.Interval() != test.interval {
+			t.Errorf("Run %d: expected %v every %v after exit %d, got %v every %v", i+1, test.state, test.interval, test.exit, driver.Rule.LastState, driver.dt.Interval())
+		}
+	}
+
+	if driver.changeState.state() != RuleStateFail {
+		t.Errorf("Expected the change state to follow, got %v", driver.changeState.state())
+	}
+
+	if state, ok := ParseRuleState("Warning"); !ok || state != RuleStateWarning || state.Name() != "warning" {
+		t.Errorf("Expected warning to be a state, got %v", state)
+	}
+}
+
+func TestRuleExitState(t *testing.T) {
+	tests := []struct {
+		cfg    string
+		states [4]RuleStateType // of exit statuses 0 through 3
+	}{
+		{``, [4]RuleStateType{RuleStateSuccess, RuleStateFail, RuleStateFail, RuleStateFail}},
+		{`warning_exit_codes=1; unknown_exit_codes="3-255"`, [4]RuleStateType{RuleStateSuccess, RuleStateWarning, RuleStateFail, RuleStateUnknown}},
+		{`success_exit_codes=[0, 1]`, [4]RuleStateType{RuleStateSuccess, RuleStateSuccess, RuleStateFail, RuleStateFail}},
+		{`fail_exit_codes=2`, [4]RuleStateType{RuleStateSuccess, RuleStateSuccess, RuleStateFail, RuleStateSuccess}},
+		{`success_exit_codes=1; fail_exit_codes=2`, [4]RuleStateType{RuleStateFail, RuleStateSuccess, RuleStateFail, RuleStateFail}},
+	}
+
+	for _, test := range tests {
+		var c Configuration
+
+		if e := c.SetConfiguration(`g1 { ` + test.cfg + `; r1 { test="true" } }`); e != nil {
+			t.Fatalf("Received error for config: %v", e)
+		}
+
+		for code, expected := range test.states {
+			if got := c.Rules["g1/r1"].exitState(code); got != expected {
+				t.Errorf("%s: expected exit status %d to be %v, got %v", test.cfg, code, expected, got)
+			}
+		}
+	}
+}
+
+func TestDriverTimeoutState(t *testing.T) {
+	for _, test := range []struct {
+		cfg   string
+		state RuleStateType
+	}{
+		{``, RuleStateFail},
+		{`timeout_state="warning"`, RuleStateWarning},
+		{`timeout_state="unknown"`, RuleStateUnknown},
+	} {
+		var c Configuration
+
+		if e := c.SetConfiguration(`r1 { runs=1; timeout_kill=0.05; test="sleep"; test_arguments="5"; ` + test.cfg + ` }`); e != nil {
+			t.Fatalf("Received error for config: %v", e)
+		}
+
+		ruleDone := make(chan *RuleDriver)
+		driver := NewRuleDriver(*c.Rules["r1"], ruleDone, 0)
+		go driver.Run()
+		<-ruleDone
+
+		s := driver.Snapshot()
+		if s.Rule.LastState != test.state || s.LastSignal != syscall.SIGKILL {
+			t.Errorf("%s: expected %v, killed, got %v, signal %v", test.cfg, test.state, s.Rule.LastState, s.LastSignal)
+		}
+	}
+}
+
+func TestDriverJitter(t *testing.T) {
+	var c Configuration
+
+	cfg := `g1 { jitter="50%"; jitter_seed=42; r1 { test="true"; interval=10s } r2 { test="true"; interval=10s } } r3 { test="true"; jitter=2s }`
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	delays := func(name string) []time.Duration {
+		driver := NewRuleDriver(*c.Rules[name], nil, 0)
+
+		var l []time.Duration
+		for i := 0; i < 5; i++ {
+			d := driver.jitter(driver.Rule.Interval)
+			if d < 0 || d >= 5*time.Second {
+				t.Errorf("Expected jitter within 50%% of 10s, got: %v", d)
+			}
+			l = append(l, d)
+		}
+
+		return l
+	}
+
+	if a, b := delays("g1/r1"), delays("g1/r1"); !reflect.DeepEqual(a, b) {
+		t.Errorf("Expected the same jitter from the same seed, got: %v, and %v", a, b)
+	}
+
+	if a, b := delays("g1/r1"), delays("g1/r2"); reflect.DeepEqual(a, b) {
+		t.Errorf("Expected rules sharing a seed to jitter differently, got: %v", a)
+	}
+
+	driver := NewRuleDriver(*c.Rules["r3"], nil, 0)
+	if d := driver.jitter(time.Hour); d < 0 || d >= 2*time.Second {
+		t.Errorf("Expected jitter within 2s, got: %v", d)
+	}
+
+	if e := c.SetConfiguration(`r1 { test="true"; jitter="150%" }`); e == nil {
+		t.Errorf("Expected error for a percentage over 100")
+	}
+}
+
+func TestDriverWarningInherited(t *testing.T) {
+	var c Configuration
+
+	cfg := `nagios {
+		warning_exit_codes=1
+		unknown_exit_codes=3
+		warn { test="/bin/sh"; test_arguments=["-c", "exit 1"]; runs=1 }
+		crit { test="/bin/sh"; test_arguments=["-c", "exit 2"]; runs=1 }
+		plain { test="/bin/sh"; test_arguments=["-c", "exit 1"]; runs=1; warning_exit_codes=[] }
+	}`
+	if e := c.SetConfiguration(cfg); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	for name, expected := range map[string]RuleStateType{"warn": RuleStateWarning, "crit": RuleStateFail, "plain": RuleStateFail} {
+		ruleDone := make(chan *RuleDriver)
+
+		driver := NewRuleDriver(*c.Rules["nagios/"+name], ruleDone, 0)
+		go driver.Run()
+		<-ruleDone
+
+		if driver.Rule.LastState != expected {
+			t.Errorf("%s: expected %v after exit %d, got %v", name, expected, driver.Last.ExitStatus, driver.Rule.LastState)
+		}
+	}
+}
@@ -4,9 +4,9 @@ package main
 
 import "fmt"
 
-const _RuleStateType_name = "RuleStateUnknownRuleStateSuccessRuleStateFail"
+const _RuleStateType_name = "RuleStateUnknownRuleStateSuccessRuleStateFailRuleStateWarning"
 
-var _RuleStateType_index = [...]uint8{0, 16, 32, 45}
+var _RuleStateType_index = [...]uint8{0, 16, 32, 45, 61}
 
 func (i RuleStateType) String() string {
 	if i < 0 || i >= RuleStateType(len(_RuleStateType_index)-1) {
@@ -0,0 +1,421 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* definitions */
+
+/* where time comes from, so schedules can be tested without waiting */
+type Clock interface {
+	Now() time.Time
+
+	/* a channel that receives the time after d, and a function to stop it */
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type realClock struct{}
+
+/* the minutes, hours, days of the month, months, and days of the week a cron
+ * expression matches, as bit sets
+ */
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+
+	/* whether the days of the month, or week started with *, which
+	 * changes how they combine
+	 */
+	domStar, dowStar bool
+}
+
+/* When a rule runs, as any of a number of cron expressions, in a time zone.
+ * Runs that fall in a gap when clocks go forward happen once the clocks have
+ * gone forward, and runs in the hour repeated when clocks go back happen the
+ * first time around.
+ */
+type Schedule struct {
+	specs    []cronSpec
+	location *time.Location
+}
+
+/* a cron field's range, and the names it accepts */
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+var cronFields = [5]cronField{
+	{0, 59, nil},
+	{0, 23, nil},
+	{1, 31, nil},
+	{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+/* shorthands for common cron expressions */
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+/* the days of the week calendar expressions accept, as cron */
+var calendarDays = map[string]string{
+	"daily":    "*",
+	"weekdays": "1-5",
+	"weekends": "0,6",
+}
+
+/* how far ahead to look for a run before giving up */
+const scheduleHorizon = 5 * 366 * 24 * time.Hour
+
+/* meat */
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+/* the rule's time zone, local time if it has none */
+func (rule *Rule) location() (*time.Location, error) {
+	if rule.Timezone == "" {
+		return time.Local, nil
+	}
+
+	return time.LoadLocation(rule.Timezone)
+}
+
+/* the rule's schedule, in its time zone */
+func (rule *Rule) schedule() (*Schedule, error) {
+	loc, err := rule.location()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSchedule(rule.Schedule, loc)
+}
+
+/* Parse a schedule, in the time zone loc, which is one of:
+ *
+ *   - a cron expression of minute, hour, day of month, month, and day of
+ *     week, such as "*\/5 * * * *"
+ *   - a cron shorthand, such as "@daily"
+ *   - a calendar expression of days at times, such as "daily at 02:30",
+ *     "weekdays at 08:00,17:30", "mon,thu at 12:00", or "hourly at :15"
+ */
+func ParseSchedule(s string, loc *time.Location) (*Schedule, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if macro, ok := cronMacros[s]; ok {
+		s = macro
+	}
+
+	var exprs []string
+	if strings.Contains(s, " at ") {
+		var err error
+		if exprs, err = calendarToCron(s); err != nil {
+			return nil, err
+		}
+	} else {
+		exprs = []string{s}
+	}
+
+	sched := &Schedule{location: loc}
+	for _, expr := range exprs {
+		spec, err := parseCron(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		sched.specs = append(sched.specs, spec)
+	}
+
+	if sched.Next(time.Now()).IsZero() {
+		return nil, errors.New("never runs")
+	}
+
+	return sched, nil
+}
+
+/* turn "<days> at <times>" into a cron expression per time */
+func calendarToCron(s string) ([]string, error) {
+	parts := strings.SplitN(s, " at ", 2)
+	days, times := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+	var exprs []string
+
+	if days == "hourly" {
+		for _, t := range strings.Split(times, ",") {
+			t = strings.TrimSpace(t)
+			if !strings.HasPrefix(t, ":") {
+				return nil, fmt.Errorf("expected ':mm', got '%s'", t)
+			}
+
+			minute, err := strconv.Atoi(t[1:])
+			if err != nil || minute < 0 || minute > 59 {
+				return nil, fmt.Errorf("invalid minute '%s'", t)
+			}
+
+			exprs = append(exprs, fmt.Sprintf("%d * * * *", minute))
+		}
+
+		return exprs, nil
+	}
+
+	dow, ok := calendarDays[days]
+	if !ok {
+		/* a list of day names, checked as cron */
+		dow = strings.Replace(days, " ", "", -1)
+	}
+
+	for _, t := range strings.Split(times, ",") {
+		hm, err := time.Parse("15:04", strings.TrimSpace(t))
+		if err != nil {
+			return nil, fmt.Errorf("expected 'hh:mm', got '%s'", strings.TrimSpace(t))
+		}
+
+		exprs = append(exprs, fmt.Sprintf("%d %d * * %s", hm.Minute(), hm.Hour(), dow))
+	}
+
+	return exprs, nil
+}
+
+/* parse the five fields of a cron expression */
+func parseCron(s string) (cronSpec, error) {
+	var spec cronSpec
+
+	fields := strings.Fields(s)
+	if len(fields) != len(cronFields) {
+		return spec, fmt.Errorf("expected %d fields, got %d in '%s'", len(cronFields), len(fields), s)
+	}
+
+	sets := []*uint64{&spec.minute, &spec.hour, &spec.dom, &spec.month, &spec.dow}
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return spec, err
+		}
+
+		*sets[i] = set
+	}
+
+	/* 7 is also sunday */
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+
+	/* as with cron, a day starting with * doesn't restrict the day, even
+	 * with a step
+	 */
+	spec.domStar = strings.HasPrefix(fields[2], "*")
+	spec.dowStar = strings.HasPrefix(fields[4], "*")
+
+	return spec, nil
+}
+
+/* a comma separated list of *, values, or ranges, each with an optional step */
+func parseCronField(s string, f cronField) (uint64, error) {
+	var set uint64
+
+	for _, item := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in '%s'", item)
+			}
+			item = item[:i]
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			parts := strings.SplitN(item, "-", 2)
+
+			var err error
+			if lo, err = f.value(parts[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(parts[1]); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range '%s'", item)
+			}
+		default:
+			var err error
+			if lo, err = f.value(item); err != nil {
+				return 0, err
+			}
+
+			/* a single value is only a range with a step */
+			if step == 1 {
+				hi = lo
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+/* a value in the field's range, by number or name */
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if s == name {
+			return f.min + i, nil
+		}
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value '%s', must be in %d..%d", s, f.min, f.max)
+	}
+
+	return v, nil
+}
+
+/* whether the wall clock time, given in UTC, matches */
+func (spec *cronSpec) matches(c time.Time) bool {
+	if spec.minute&(1<<uint(c.Minute())) == 0 || spec.hour&(1<<uint(c.Hour())) == 0 || spec.month&(1<<uint(c.Month())) == 0 {
+		return false
+	}
+
+	return spec.matchesDay(c)
+}
+
+/* like cron, when both days are restricted, either may match */
+func (spec *cronSpec) matchesDay(c time.Time) bool {
+	dom := spec.dom&(1<<uint(c.Day())) != 0
+	dow := spec.dow&(1<<uint(c.Weekday())) != 0
+
+	if spec.domStar || spec.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+func (s *Schedule) matches(c time.Time) bool {
+	for i := range s.specs {
+		if s.specs[i].matches(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Schedule) matchesDay(c time.Time) bool {
+	for i := range s.specs {
+		if s.specs[i].month&(1<<uint(c.Month())) != 0 && s.specs[i].matchesDay(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* the wall clock time at t, in the schedule's location, as UTC to compare */
+func (s *Schedule) wall(t time.Time) time.Time {
+	l := t.In(s.location)
+	return time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), 0, 0, time.UTC)
+}
+
+/* whether the wall clock already read c in the few hours before t, as when
+ * clocks go back
+ */
+func (s *Schedule) repeated(t time.Time, c time.Time) bool {
+	for back := 15 * time.Minute; back <= 3*time.Hour; back += 15 * time.Minute {
+		if s.wall(t.Add(-back)).Equal(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* The next time the schedule runs, strictly after t, or zero if it doesn't
+ * within a few years.  Walks forward in real time, a minute at a time on
+ * days that match, so gaps and repeats in the wall clock fall out of it.
+ */
+func (s *Schedule) Next(t time.Time) time.Time {
+	end := t.Add(scheduleHorizon)
+
+	for x := t.Truncate(time.Minute).Add(time.Minute); x.Before(end); {
+		c := s.wall(x)
+		prev := s.wall(x.Add(-time.Minute))
+
+		/* the clocks went forward, run once for anything skipped */
+		if c.Sub(prev) > time.Minute {
+			for m := prev.Add(time.Minute); m.Before(c); m = m.Add(time.Minute) {
+				if s.matches(m) {
+					return x
+				}
+			}
+		}
+
+		if !s.matchesDay(c) {
+			/* on to the start of the next day */
+			d := c.AddDate(0, 0, 1)
+			next := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, s.location)
+			if !next.After(x) {
+				next = x.Add(time.Minute)
+			}
+			x = next
+			continue
+		}
+
+		if s.matches(c) && !s.repeated(x, c) {
+			return x
+		}
+
+		x = x.Add(time.Minute)
+	}
+
+	return time.Time{}
+}
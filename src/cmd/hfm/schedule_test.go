@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "sync"
+import "testing"
+import "time"
+
+/* a clock whose timers fire straight away, moving the time on to when they
+ * would have
+ */
+type jumpingClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *jumpingClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now
+}
+
+func (c *jumpingClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+
+	return ch, func() bool { return false }
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("No time zone data for %s: %v", name, err)
+	}
+
+	return loc
+}
+
+func TestScheduleNext(t *testing.T) {
+	ny := loadLocation(t, "America/New_York")
+
+	tests := []struct {
+		schedule string
+		from     time.Time
+		expected []time.Time
+	}{
+		{"*/5 * * * *", time.Date(2024, 1, 8, 10, 2, 30, 0, ny), []time.Time{
+			time.Date(2024, 1, 8, 10, 5, 0, 0, ny),
+			time.Date(2024, 1, 8, 10, 10, 0, 0, ny),
+		}},
+		{"hourly at :15", time.Date(2024, 1, 8, 10, 15, 0, 0, ny), []time.Time{
+			time.Date(2024, 1, 8, 11, 15, 0, 0, ny),
+		}},
+		// friday evening, on to monday
+		{"weekdays at 08:00,17:30", time.Date(2024, 1, 12, 18, 0, 0, 0, ny), []time.Time{
+			time.Date(2024, 1, 15, 8, 0, 0, 0, ny),
+			time.Date(2024, 1, 15, 17, 30, 0, 0, ny),
+		}},
+		// either day matches when both are given
+		{"0 0 1 * mon", time.Date(2024, 1, 28, 12, 0, 0, 0, ny), []time.Time{
+			time.Date(2024, 1, 29, 0, 0, 0, 0, ny),
+			time.Date(2024, 2, 1, 0, 0, 0, 0, ny),
+			time.Date(2024, 2, 5, 0, 0, 0, 0, ny),
+		}},
+		// a step over every day still takes both days
+		{"0 0 */2 * mon", time.Date(2024, 1, 28, 12, 0, 0, 0, ny), []time.Time{
+			time.Date(2024, 1, 29, 0, 0, 0, 0, ny),
+			time.Date(2024, 2, 5, 0, 0, 0, 0, ny),
+			time.Date(2024, 2, 19, 0, 0, 0, 0, ny),
+		}},
+		{"0 0 1 * */2", time.Date(2024, 1, 28, 12, 0, 0, 0, ny), []time.Time{
+			time.Date(2024, 2, 1, 0, 0, 0, 0, ny),
+			time.Date(2024, 6, 1, 0, 0, 0, 0, ny),
+		}},
+		{"@monthly", time.Date(2024, 1, 15, 0, 0, 0, 0, ny), []time.Time{
+			time.Date(2024, 2, 1, 0, 0, 0, 0, ny),
+		}},
+		// 02:30 doesn't exist when the clocks go forward, run once they have
+		{"daily at 02:30", time.Date(2024, 3, 9, 3, 0, 0, 0, ny), []time.Time{
+			time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 11, 6, 30, 0, 0, time.UTC),
+		}},
+		{"0 * * * *", time.Date(2024, 3, 10, 0, 30, 0, 0, ny), []time.Time{
+			time.Date(2024, 3, 10, 6, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 10, 8, 0, 0, 0, time.UTC),
+		}},
+		// 01:30 happens twice when the clocks go back, run the first time
+		{"30 1 * * *", time.Date(2024, 11, 3, 0, 0, 0, 0, ny), []time.Time{
+			time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC),
+			time.Date(2024, 11, 4, 6, 30, 0, 0, time.UTC),
+		}},
+	}
+
+	for _, test := range tests {
+		sched, err := ParseSchedule(test.schedule, ny)
+		if err != nil {
+			t.Errorf("Received error for '%s': %v", test.schedule, err)
+			continue
+		}
+
+		from := test.from
+		for i, expected := range test.expected {
+			next := sched.Next(from)
+			if !next.Equal(expected) {
+				t.Errorf("Expected run %d of '%s' at %v, got: %v", i+1, test.schedule, expected.In(ny), next.In(ny))
+				break
+			}
+			from = next
+		}
+	}
+
+	for _, bad := range []string{"61 * * * *", "* * *", "0 0 30 2 *", "*/0 * * * *", "5-1 * * * *", "someday at 12:00", "daily at 25:00", "hourly at 15"} {
+		if _, err := ParseSchedule(bad, ny); err == nil {
+			t.Errorf("Expected error for '%s'", bad)
+		}
+	}
+}
+
+func TestDelayedTickerSchedule(t *testing.T) {
+	ny := loadLocation(t, "America/New_York")
+
+	sched, err := ParseSchedule("0 * * * *", ny)
+	if err != nil {
+		t.Fatalf("Received error for schedule: %v", err)
+	}
+
+	dt := NewDelayedTicker()
+	dt.Schedule = sched
+	dt.Clock = &jumpingClock{now: time.Date(2024, 3, 10, 0, 30, 0, 0, ny)}
+	dt.Start(0, 0)
+
+	// 02:00 is skipped by the clocks going forward, so it runs at 03:00,
+	// along with 03:00's
+	expected := []time.Time{
+		time.Date(2024, 3, 10, 1, 0, 0, 0, ny),
+		time.Date(2024, 3, 10, 3, 0, 0, 0, ny),
+		time.Date(2024, 3, 10, 4, 0, 0, 0, ny),
+	}
+	for i, e := range expected {
+		if tick := <-dt.C; !tick.Equal(e) {
+			t.Errorf("Expected tick %d at %v, got: %v", i+1, e, tick.In(ny))
+		}
+	}
+	dt.Stop()
+
+	if interval := dt.Interval(); interval != 0 {
+		t.Errorf("Expected no interval for a schedule, got: %v", interval)
+	}
+}
+
+func TestDriverSchedule(t *testing.T) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`r1 { test="true"; schedule="*/5 * * * *"; timezone="UTC"; interval=1s; runs=3 }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	ruleDone := make(chan *RuleDriver)
+	driver := NewRuleDriver(*c.Rules["r1"], ruleDone, 0)
+	driver.clock = &jumpingClock{now: time.Date(2024, 1, 8, 10, 2, 0, 0, time.UTC)}
+	go driver.Run()
+	<-ruleDone
+
+	s := driver.Snapshot()
+	if expected := time.Date(2024, 1, 8, 10, 15, 0, 0, time.UTC); s.Count != 3 || !s.LastScheduledStart.Equal(expected) {
+		t.Errorf("Expected 3 runs, the last scheduled at %v, got %d runs, the last at %v", expected, s.Count, s.LastScheduledStart)
+	}
+
+	if e := c.SetConfiguration(`r1 { test="true"; schedule="daily at 02:30"; timezone="Nowhere/Special" }`); e == nil {
+		t.Errorf("Expected error for an unknown timezone")
+	}
+
+	// there's no interval to take a percentage of
+	if e := c.SetConfiguration(`g1 { jitter="10%"; r1 { test="true"; schedule="daily at 02:30" } }`); e == nil {
+		t.Errorf("Expected error for a percentage jitter with a schedule")
+	}
+	if e := c.SetConfiguration(`r1 { test="true"; schedule="daily at 02:30"; jitter=5s }`); e != nil {
+		t.Errorf("Received error for an interval jitter with a schedule: %v", e)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* definitions */
+
+/* what's kept of a rule across restarts */
+type PersistedRule struct {
+	State          string
+	ChangeDebounce uint16
+	LastTransition time.Time
+	Count          uint64
+}
+
+/* Rule state kept on disk, so a restart doesn't look like every rule has
+ * changed state.  Rewritten as a whole on each update, by renaming a
+ * temporary file over it, so it's never seen half written.
+ */
+type StateFile struct {
+	sync.Mutex
+
+	Path string
+
+	/* string maps to rule name */
+	rules map[string]PersistedRule
+
+	/* recorded since the file was last written */
+	dirty bool
+}
+
+/* the layout of the file */
+type stateFileContents struct {
+	Rules map[string]PersistedRule
+}
+
+/* meat */
+
+/* load the state file at path, a missing file is an empty one */
+func LoadStateFile(path string) (*StateFile, error) {
+	sf := &StateFile{Path: path, rules: make(map[string]PersistedRule)}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return sf, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var contents stateFileContents
+	if err := json.Unmarshal(buf, &contents); err != nil {
+		return nil, err
+	}
+
+	for name, pr := range contents.Rules {
+		sf.rules[name] = pr
+	}
+
+	return sf, nil
+}
+
+/* the persisted state of a rule, safe to call on nil */
+func (sf *StateFile) get(name string) (PersistedRule, bool) {
+	if sf == nil {
+		return PersistedRule{}, false
+	}
+
+	sf.Lock()
+	defer sf.Unlock()
+
+	pr, ok := sf.rules[name]
+	return pr, ok
+}
+
+/* record the state of a rule, and write the file, safe to call on nil */
+func (sf *StateFile) update(name string, pr PersistedRule) error {
+	if sf == nil {
+		return nil
+	}
+
+	sf.Lock()
+	defer sf.Unlock()
+
+	sf.rules[name] = pr
+	return sf.write()
+}
+
+/* record the state of a rule, without writing the file, safe to call on
+ * nil
+ */
+func (sf *StateFile) record(name string, pr PersistedRule) {
+	if sf == nil {
+		return
+	}
+
+	sf.Lock()
+	defer sf.Unlock()
+
+	sf.rules[name] = pr
+	sf.dirty = true
+}
+
+/* write anything recorded since the file was last written, safe to call on
+ * nil
+ */
+func (sf *StateFile) flush() error {
+	if sf == nil {
+		return nil
+	}
+
+	sf.Lock()
+	defer sf.Unlock()
+
+	if !sf.dirty {
+		return nil
+	}
+
+	return sf.write()
+}
+
+/* forget a rule, and write the file, safe to call on nil */
+func (sf *StateFile) remove(name string) error {
+	if sf == nil {
+		return nil
+	}
+
+	sf.Lock()
+	defer sf.Unlock()
+
+	if _, ok := sf.rules[name]; !ok {
+		return nil
+	}
+
+	delete(sf.rules, name)
+	return sf.write()
+}
+
+/* write the file atomically, must hold the lock */
+func (sf *StateFile) write() error {
+	buf, err := json.MarshalIndent(stateFileContents{Rules: sf.rules}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(sf.Path), filepath.Base(sf.Path)+".")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), sf.Path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	sf.dirty = false
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import "bytes"
+import "io/ioutil"
+import "os"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+func TestStateFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sf, err := LoadStateFile(dir + "/state")
+	if err != nil {
+		t.Fatalf("Expected a missing state file to load empty, got: %v", err)
+	}
+
+	pr := PersistedRule{State: "fail", ChangeDebounce: 2, LastTransition: time.Unix(1500000000, 0).UTC(), Count: 7}
+	if e := sf.update("r1", pr); e != nil {
+		t.Fatalf("Could not write state file: %v", e)
+	}
+	if e := sf.update("r2", pr); e != nil {
+		t.Fatalf("Could not write state file: %v", e)
+	}
+	if e := sf.remove("r2"); e != nil {
+		t.Fatalf("Could not write state file: %v", e)
+	}
+
+	sf, err = LoadStateFile(dir + "/state")
+	if err != nil {
+		t.Fatalf("Could not load state file: %v", err)
+	}
+
+	if got, ok := sf.get("r1"); !ok || !reflect.DeepEqual(got, pr) {
+		t.Errorf("Expected r1 to be %+v, got: %+v", pr, got)
+	}
+	if _, ok := sf.get("r2"); ok {
+		t.Errorf("Expected r2 to be removed")
+	}
+
+	// no temporary files left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected only the state file in %v, got %d files", dir, len(files))
+	}
+}
+
+func TestStateFileNil(t *testing.T) {
+	var sf *StateFile
+
+	if e := sf.update("r1", PersistedRule{}); e != nil {
+		t.Errorf("Expected update on nil to be a no-op, got: %v", e)
+	}
+	if _, ok := sf.get("r1"); ok {
+		t.Errorf("Expected nothing from a nil state file")
+	}
+
+	sf.record("r1", PersistedRule{})
+	if e := sf.flush(); e != nil {
+		t.Errorf("Expected flush on nil to be a no-op, got: %v", e)
+	}
+}
+
+/* run a rule once, which restored its state from sf, and count change commands */
+func runRestoredRule(t *testing.T, sf *StateFile, cfg string) (*RuleDriver, string) {
+	var c Configuration
+
+	if e := c.SetConfiguration(`r1 { test="true"; runs=1; change_success="/bin/sh"; change_success_arguments=["-c", "echo $HFM_NEW_STATE"]; ` + cfg + ` }`); e != nil {
+		t.Fatalf("Received error for config: %v", e)
+	}
+
+	m := NewMetrics()
+	ruleDone := make(chan *RuleDriver)
+
+	driver := NewRuleDriver(*c.Rules["r1"], ruleDone, 0)
+	driver.metrics = m.rule("r1", "")
+	driver.restoreState(sf)
+	go driver.Run()
+	<-ruleDone
+
+	var buf bytes.Buffer
+	m.Expose(&buf)
+
+	return driver, buf.String()
+}
+
+func TestDriverRestoreState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sf, _ := LoadStateFile(dir + "/state")
+	since := time.Unix(1500000000, 0).UTC()
+	sf.update("r1", PersistedRule{State: "success", LastTransition: since, Count: 5})
+
+	changes := `hfm_rule_change_commands_total{rule="r1",group="",state="success",result="success"} 1`
+
+	driver, out := runRestoredRule(t, sf, ``)
+	if strings.Contains(out, changes) {
+		t.Errorf("Expected no change command for a restored, unchanged state, got:\n%s", out)
+	}
+
+	snap := driver.Snapshot()
+	if snap.Rule.LastState != RuleStateSuccess || !snap.LastTransition.Equal(since) {
+		t.Errorf("Expected restored state success since %v, got: %v since %v", since, snap.Rule.LastState, snap.LastTransition)
+	}
+
+	// an unchanged state isn't written, the run count waits for a flush
+	if pr, _ := LoadStateFile(dir + "/state"); pr != nil {
+		if got, _ := pr.get("r1"); got.Count != 5 {
+			t.Errorf("Expected the state file unwritten for an unchanged state, got: %+v", got)
+		}
+	}
+
+	if e := sf.flush(); e != nil {
+		t.Fatalf("Could not write state file: %v", e)
+	}
+
+	sf, _ = LoadStateFile(dir + "/state")
+	if pr, _ := sf.get("r1"); pr.State != "success" || !pr.LastTransition.Equal(since) || pr.Count != 6 {
+		t.Errorf("Expected the run counted, with the state unchanged, got: %+v", pr)
+	}
+
+	_, out = runRestoredRule(t, sf, `change_on_restore=true`)
+	if !strings.Contains(out, changes) {
+		t.Errorf("Expected a change command with change_on_restore, got:\n%s", out)
+	}
+}
+
+func TestDriverPersistState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sf, _ := LoadStateFile(dir + "/state")
+	runRestoredRule(t, sf, ``)
+
+	sf, _ = LoadStateFile(dir + "/state")
+	pr, ok := sf.get("r1")
+	if !ok || pr.State != "success" || pr.Count != 1 || pr.LastTransition.IsZero() {
+		t.Errorf("Expected r1 persisted as success after 1 run, got: %+v", pr)
+	}
+}
+
+func TestDriverDetached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hfm-test-suite-")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sf, _ := LoadStateFile(dir + "/state")
+	deps := NewDependencies()
+
+	driver := NewRuleDriver(Rule{Name: "r1"}, nil, 0)
+	driver.restoreState(sf)
+	driver.deps = deps
+
+	// a run finishing after the driver was replaced
+	driver.detach()
+	driver.Rule.LastState = RuleStateFail
+	driver.persist()
+	driver.shareState()
+
+	if _, ok := sf.get("r1"); ok {
+		t.Errorf("Expected a detached driver not to write the state file")
+	}
+	if state := deps.state("r1"); state != RuleStateUnknown {
+		t.Errorf("Expected a detached driver not to share its state, got: %v", state)
+	}
+}
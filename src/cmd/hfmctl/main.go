@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2016, Derek Marcotte
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright
+ * notice, this list of conditions and the following disclaimer in the
+ * documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+/* stdlib includes */
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+/* definitions */
+
+/* mirrors the request and response in hfm's control.go */
+type ControlRequest struct {
+	Command string
+	Args    []string
+}
+
+type ControlResponse struct {
+	Error  string
+	Result json.RawMessage
+}
+
+/* meat */
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-socket path] command [arguments]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "\tlist\n")
+	fmt.Fprintf(os.Stderr, "\tshow <rule|group>\n")
+	fmt.Fprintf(os.Stderr, "\tenable <rule|group>\n")
+	fmt.Fprintf(os.Stderr, "\tdisable <rule|group>\n")
+	fmt.Fprintf(os.Stderr, "\trun <rule|group>\n")
+	fmt.Fprintf(os.Stderr, "\toverride <rule|group> <enabled|always-fail|always-success|clear> [duration]\n")
+	fmt.Fprintf(os.Stderr, "\tmaintenance <rule|group> <duration|clear>\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var socketPath string
+	var timeout time.Duration
+
+	flag.StringVar(&socketPath, "socket", "/var/run/hfm.sock", "Path to the hfm control socket")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "How long to wait for hfm to answer")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to %v: %v\n", socketPath, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request := ControlRequest{Command: flag.Arg(0), Args: flag.Args()[1:]}
+	if err := json.NewEncoder(conn).Encode(&request); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not send request: %v\n", err)
+		os.Exit(1)
+	}
+
+	var response ControlResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read response: %v\n", err)
+		os.Exit(1)
+	}
+
+	if response.Error != "" {
+		fmt.Fprintf(os.Stderr, "%s\n", response.Error)
+		os.Exit(1)
+	}
+
+	if len(response.Result) == 0 {
+		return
+	}
+
+	var out interface{}
+	json.Unmarshal(response.Result, &out)
+	buf, _ := json.MarshalIndent(out, "", "\t")
+
+	fmt.Printf("%s\n", buf)
+}